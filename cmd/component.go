@@ -2,22 +2,32 @@ package cmd
 
 import (
 	"context"
+	"errors"
+	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"xorkevin.dev/anvil/component"
+	"xorkevin.dev/anvil/util/ktrace"
 	"xorkevin.dev/kerrors"
 	"xorkevin.dev/klog"
 )
 
 type (
 	componentFlags struct {
-		output string
-		input  string
-		cache  string
-		opts   component.Opts
+		output     string
+		input      string
+		cache      string
+		opts       component.Opts
+		format     string
+		watch      bool
+		sink       string
+		workspace  string
+		timing     string
+		timingFile string
 	}
 )
 
@@ -33,20 +43,80 @@ func (c *Cmd) getComponentCmd() *cobra.Command {
 	componentCmd.PersistentFlags().StringVarP(&c.componentFlags.input, "input", "i", "", "main component definition")
 	componentCmd.PersistentFlags().StringVarP(&c.componentFlags.cache, "cache", "c", "", "repo cache directory")
 	componentCmd.PersistentFlags().BoolVarP(&c.componentFlags.opts.DryRun, "dry-run", "n", false, "dry run writing components")
+	componentCmd.Flags().BoolVar(&c.componentFlags.opts.Check, "check", false, "exit with an error if generated outputs are out of date")
+	componentCmd.PersistentFlags().IntVarP(&c.componentFlags.opts.Jobs, "jobs", "j", 1, "max number of repos and templates to process concurrently")
 	componentCmd.PersistentFlags().BoolVarP(&c.componentFlags.opts.NoNetwork, "no-network", "m", false, "error if the network is required")
 	componentCmd.PersistentFlags().BoolVarP(&c.componentFlags.opts.ForceFetch, "force-fetch", "f", false, "force refetching repos regardless of cache")
 	componentCmd.PersistentFlags().StringVar(&c.componentFlags.opts.RepoChecksumFile, "repo-sum", "anvil.sum.json", "checksum file")
+	componentCmd.PersistentFlags().BoolVar(&c.componentFlags.opts.RepoSumStrict, "repo-sum-strict", false, "error if a non-local repo has no recorded checksum or is replaced, and report unused checksums without rewriting the checksum file")
+	componentCmd.PersistentFlags().StringVar(&c.componentFlags.opts.ManifestFile, "manifest", "anvil.manifest.json", "generated output manifest file")
+	componentCmd.PersistentFlags().StringVar(&c.componentFlags.opts.OverrideFile, "override-file", "", "local override file of repo replacements, e.g. anvil.override.yaml")
+	componentCmd.PersistentFlags().StringArrayVar(&c.componentFlags.opts.Replace, "replace", nil, "replace a git repo with a local dir of the form repo[@tag]=dir, may be repeated")
 	componentCmd.PersistentFlags().StringVar(&c.componentFlags.opts.GitDir, "git-dir", ".git", "git repo dir (.git)")
 	componentCmd.PersistentFlags().StringVar(&c.componentFlags.opts.GitBin, "git-cmd", "git", "git cmd")
 	componentCmd.PersistentFlags().BoolVar(&c.componentFlags.opts.GitBinQuiet, "git-cmd-quiet", false, "quiet git cmd output")
 	componentCmd.PersistentFlags().StringVar(&c.componentFlags.opts.JsonnetLibName, "jsonnet-stdlib", "anvil:std", "jsonnet std lib import name")
+	componentCmd.Flags().StringVar(&c.componentFlags.opts.ProvenanceFile, "provenance", "", "generated output provenance file")
+	componentCmd.PersistentFlags().BoolVar(&c.componentFlags.opts.GeneratedHeaders, "generated-header", false, "insert a generated by header comment into outputs of known file types")
+	componentCmd.Flags().BoolVarP(&c.componentFlags.watch, "watch", "w", false, "regenerate components when local sources change")
+	componentCmd.Flags().StringVar(&c.componentFlags.sink, "sink", componentSinkDir, "output sink (dir, tar, zip, stream); non dir sinks require an explicit output file, or - for stdout")
+	componentCmd.PersistentFlags().BoolVar(&c.componentFlags.opts.NoHooks, "no-hooks", false, "do not run component hooks on rendered outputs")
+	componentCmd.PersistentFlags().BoolVar(&c.componentFlags.opts.AllowRemoteHooks, "allow-remote-hooks", false, "run hooks declared by components from remote repos")
+	componentCmd.Flags().BoolVarP(&c.componentFlags.opts.KeepGoing, "keep-going", "k", false, "generate every component and template that does not fail rather than stopping at the first failure")
+	componentCmd.Flags().StringVar(&c.componentFlags.opts.FailureReportFile, "failure-report", "", "json report file of failures collected with --keep-going")
+	componentCmd.PersistentFlags().StringVar(&c.componentFlags.timing, "timing", "", "write a timing report of repo fetches, checksums, config parses, template renders, and output writes (table, trace)")
+	componentCmd.PersistentFlags().StringVar(&c.componentFlags.timingFile, "timing-file", "", "timing report file, or stderr if empty; trace reports are chrome trace json")
+	componentCmd.PersistentFlags().StringArrayVar(&c.componentFlags.opts.ArgsFiles, "args-file", nil, "root component args json or yaml file, may be repeated and merged in order")
+	componentCmd.PersistentFlags().StringArrayVar(&c.componentFlags.opts.Args, "set", nil, "root component arg of the form key.path=value, may be repeated and applied in order after args files")
 
 	viper.SetDefault("component.repocache", "")
 
+	diffCmd := &cobra.Command{
+		Use:               "diff",
+		Short:             "Prints a diff of rendered component changes",
+		Long:              `Prints a unified diff of rendered component changes against the output directory`,
+		Run:               c.execComponentDiffCmd,
+		DisableAutoGenTag: true,
+	}
+	componentCmd.AddCommand(diffCmd)
+
+	graphCmd := &cobra.Command{
+		Use:               "graph",
+		Short:             "Prints the component dependency graph",
+		Long:              `Prints the resolved component dependency graph as graphviz dot or json`,
+		Run:               c.execComponentGraphCmd,
+		DisableAutoGenTag: true,
+	}
+	graphCmd.PersistentFlags().StringVar(&c.componentFlags.format, "format", component.GraphFormatDot, "graph output format (dot, json)")
+	componentCmd.AddCommand(graphCmd)
+
+	updateCmd := &cobra.Command{
+		Use:               "update",
+		Short:             "Updates locked floating repo refs",
+		Long:              `Resolves repo specs that follow a branch to their latest commit and rewrites the locks in the repo checksum file`,
+		Run:               c.execComponentUpdateCmd,
+		DisableAutoGenTag: true,
+	}
+	componentCmd.AddCommand(updateCmd)
+
+	workspaceCmd := &cobra.Command{
+		Use:               "workspace",
+		Short:             "Generates every root component of a workspace",
+		Long:              `Generates every root component listed in a workspace file, sharing repo and config caches and a single repo checksum file. The manifest and provenance files of each root are only set by its manifest and provenance fields in the workspace file, so the --manifest flag may not be used.`,
+		Run:               c.execComponentWorkspaceCmd,
+		DisableAutoGenTag: true,
+	}
+	workspaceCmd.PersistentFlags().StringVar(&c.componentFlags.workspace, "workspace", "anvil.workspace.yaml", "workspace file")
+	workspaceCmd.Flags().BoolVar(&c.componentFlags.opts.Check, "check", false, "exit with an error if generated outputs of any root are out of date")
+	workspaceCmd.Flags().BoolVarP(&c.componentFlags.opts.KeepGoing, "keep-going", "k", false, "generate every component and template that does not fail rather than stopping at the first failure")
+	workspaceCmd.Flags().StringVar(&c.componentFlags.opts.FailureReportFile, "failure-report", "", "json report file of failures collected with --keep-going")
+	componentCmd.AddCommand(workspaceCmd)
+
 	return componentCmd
 }
 
-func (c *Cmd) execComponentCmd(cmd *cobra.Command, args []string) {
+// prepareComponentOpts normalizes component flags and returns the repo cache dir
+func (c *Cmd) prepareComponentOpts() string {
 	cache := c.componentFlags.cache
 	if cache == "" {
 		cache = viper.GetString("component.repocache")
@@ -64,15 +134,266 @@ func (c *Cmd) execComponentCmd(cmd *cobra.Command, args []string) {
 	c.log.Debug(context.Background(), "Using cache dir", klog.AString("dir", cache))
 
 	c.componentFlags.opts.RepoChecksumFile = filepath.ToSlash(c.componentFlags.opts.RepoChecksumFile)
+	c.componentFlags.opts.ManifestFile = filepath.ToSlash(c.componentFlags.opts.ManifestFile)
+	c.componentFlags.opts.ProvenanceFile = filepath.ToSlash(c.componentFlags.opts.ProvenanceFile)
+	c.componentFlags.opts.FailureReportFile = filepath.ToSlash(c.componentFlags.opts.FailureReportFile)
+	c.componentFlags.opts.OverrideFile = filepath.ToSlash(c.componentFlags.opts.OverrideFile)
+	for n, i := range c.componentFlags.opts.ArgsFiles {
+		c.componentFlags.opts.ArgsFiles[n] = filepath.ToSlash(i)
+	}
+	return cache
+}
+
+const (
+	componentSinkDir = "dir"
+)
+
+// openComponentSink opens the output sink if it is not the output dir. An
+// output file is written to a temporary file in the same dir, which is renamed
+// to the output file when the sink is closed after a successful generation
+// and removed otherwise.
+func (c *Cmd) openComponentSink(cmd *cobra.Command) (component.Sink, func(ok bool) error, error) {
+	noClose := func(ok bool) error { return nil }
+	if c.componentFlags.sink == componentSinkDir {
+		return nil, noClose, nil
+	}
+	if c.componentFlags.watch {
+		return nil, nil, kerrors.WithMsg(nil, "Watch may only be used with the dir sink")
+	}
+	// the default output is a dir, which must not be clobbered by an archive
+	if !cmd.Flags().Changed("output") {
+		return nil, nil, kerrors.WithMsg(nil, "Non dir sinks require an explicit output file or - for stdout")
+	}
+	if c.componentFlags.output == "-" {
+		sink, err := component.NewSink(c.componentFlags.sink, os.Stdout)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sink, noClose, nil
+	}
+	if c.componentFlags.opts.DryRun {
+		sink, err := component.NewSink(c.componentFlags.sink, io.Discard)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sink, noClose, nil
+	}
+	output := c.componentFlags.output
+	f, err := os.CreateTemp(filepath.Dir(output), "."+filepath.Base(output)+".tmp-*")
+	if err != nil {
+		return nil, nil, kerrors.WithMsg(err, "Failed creating temporary output file")
+	}
+	discard := func() error {
+		if err := os.Remove(f.Name()); err != nil {
+			return kerrors.WithMsg(err, "Failed removing temporary output file")
+		}
+		return nil
+	}
+	sink, err := component.NewSink(c.componentFlags.sink, f)
+	if err != nil {
+		if err := f.Close(); err != nil {
+			c.log.WarnErr(context.Background(), kerrors.WithMsg(err, "Failed closing temporary output file"))
+		}
+		if err := discard(); err != nil {
+			c.log.WarnErr(context.Background(), err)
+		}
+		return nil, nil, err
+	}
+	return sink, func(ok bool) error {
+		if err := f.Close(); err != nil {
+			return errors.Join(kerrors.WithMsg(err, "Failed closing temporary output file"), discard())
+		}
+		if !ok {
+			return discard()
+		}
+		if err := os.Chmod(f.Name(), 0o644); err != nil {
+			return errors.Join(kerrors.WithMsg(err, "Failed setting output file mode"), discard())
+		}
+		if err := os.Rename(f.Name(), output); err != nil {
+			return errors.Join(kerrors.WithMsg(err, "Failed renaming temporary output file"), discard())
+		}
+		return nil
+	}, nil
+}
 
-	if err := component.Generate(
-		context.Background(),
+// startComponentTiming returns a context recording timing spans if a timing
+// report is requested, and a function that writes the report
+func (c *Cmd) startComponentTiming(ctx context.Context) (context.Context, func(), error) {
+	if c.componentFlags.timing == "" {
+		return ctx, func() {}, nil
+	}
+	if err := ktrace.CheckFormat(c.componentFlags.timing); err != nil {
+		return nil, nil, err
+	}
+	if c.componentFlags.watch {
+		return nil, nil, kerrors.WithMsg(nil, "Timing reports may not be used with watch")
+	}
+	r := ktrace.NewRecorder()
+	return ktrace.WithRecorder(ctx, r), func() {
+		if err := c.writeComponentTiming(r.Spans()); err != nil {
+			c.log.WarnErr(context.Background(), err)
+		}
+	}, nil
+}
+
+func (c *Cmd) writeComponentTiming(spans []ktrace.Span) (retErr error) {
+	var w io.Writer = os.Stderr
+	if c.componentFlags.timingFile != "" {
+		f, err := os.Create(c.componentFlags.timingFile)
+		if err != nil {
+			return kerrors.WithMsg(err, "Failed creating timing report file")
+		}
+		defer func() {
+			if err := f.Close(); err != nil {
+				retErr = errors.Join(retErr, kerrors.WithMsg(err, "Failed closing timing report file"))
+			}
+		}()
+		w = f
+	}
+	if err := ktrace.WriteReport(w, c.componentFlags.timing, spans); err != nil {
+		return kerrors.WithMsg(err, "Failed writing timing report")
+	}
+	return nil
+}
+
+func (c *Cmd) execComponentCmd(cmd *cobra.Command, args []string) {
+	cache := c.prepareComponentOpts()
+	sink, closeSink, err := c.openComponentSink(cmd)
+	if err != nil {
+		c.logFatal(err)
+		return
+	}
+	c.componentFlags.opts.Sink = sink
+	if c.componentFlags.watch {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := component.Watch(
+			ctx,
+			c.log.Logger.Sublogger("", klog.AString("cmd", "component")),
+			filepath.ToSlash(c.componentFlags.output),
+			filepath.ToSlash(c.componentFlags.input),
+			filepath.ToSlash(cache),
+			c.componentFlags.opts,
+		); err != nil {
+			c.logFatal(err)
+			return
+		}
+		return
+	}
+	ctx, writeTiming, err := c.startComponentTiming(context.Background())
+	if err != nil {
+		c.logFatal(err)
+		return
+	}
+	err = component.Generate(
+		ctx,
 		c.log.Logger.Sublogger("", klog.AString("cmd", "component")),
 		filepath.ToSlash(c.componentFlags.output),
 		filepath.ToSlash(c.componentFlags.input),
 		filepath.ToSlash(cache),
 		c.componentFlags.opts,
-	); err != nil {
+	)
+	writeTiming()
+	if err != nil {
+		if err := closeSink(false); err != nil {
+			c.log.WarnErr(context.Background(), err)
+		}
+		c.logFatal(err)
+		return
+	}
+	if err := closeSink(true); err != nil {
+		c.logFatal(err)
+		return
+	}
+}
+
+func (c *Cmd) execComponentDiffCmd(cmd *cobra.Command, args []string) {
+	cache := c.prepareComponentOpts()
+	ctx, writeTiming, err := c.startComponentTiming(context.Background())
+	if err != nil {
+		c.logFatal(err)
+		return
+	}
+	err = component.Diff(
+		ctx,
+		c.log.Logger.Sublogger("", klog.AString("cmd", "component.diff")),
+		os.Stdout,
+		filepath.ToSlash(c.componentFlags.output),
+		filepath.ToSlash(c.componentFlags.input),
+		filepath.ToSlash(cache),
+		c.componentFlags.opts,
+	)
+	writeTiming()
+	if err != nil {
+		c.logFatal(err)
+		return
+	}
+}
+
+func (c *Cmd) execComponentGraphCmd(cmd *cobra.Command, args []string) {
+	cache := c.prepareComponentOpts()
+	ctx, writeTiming, err := c.startComponentTiming(context.Background())
+	if err != nil {
+		c.logFatal(err)
+		return
+	}
+	err = component.GenerateGraph(
+		ctx,
+		c.log.Logger.Sublogger("", klog.AString("cmd", "component.graph")),
+		os.Stdout,
+		filepath.ToSlash(c.componentFlags.input),
+		filepath.ToSlash(cache),
+		c.componentFlags.format,
+		c.componentFlags.opts,
+	)
+	writeTiming()
+	if err != nil {
+		c.logFatal(err)
+		return
+	}
+}
+
+func (c *Cmd) execComponentWorkspaceCmd(cmd *cobra.Command, args []string) {
+	if cmd.Flags().Changed("manifest") {
+		c.logFatal(kerrors.WithMsg(nil, "Workspace root manifests may only be set by the workspace file"))
+		return
+	}
+	cache := c.prepareComponentOpts()
+	ctx, writeTiming, err := c.startComponentTiming(context.Background())
+	if err != nil {
+		c.logFatal(err)
+		return
+	}
+	err = component.GenerateWorkspace(
+		ctx,
+		c.log.Logger.Sublogger("", klog.AString("cmd", "component.workspace")),
+		filepath.ToSlash(c.componentFlags.workspace),
+		filepath.ToSlash(cache),
+		c.componentFlags.opts,
+	)
+	writeTiming()
+	if err != nil {
+		c.logFatal(err)
+		return
+	}
+}
+
+func (c *Cmd) execComponentUpdateCmd(cmd *cobra.Command, args []string) {
+	cache := c.prepareComponentOpts()
+	ctx, writeTiming, err := c.startComponentTiming(context.Background())
+	if err != nil {
+		c.logFatal(err)
+		return
+	}
+	err = component.Update(
+		ctx,
+		c.log.Logger.Sublogger("", klog.AString("cmd", "component.update")),
+		filepath.ToSlash(c.componentFlags.input),
+		filepath.ToSlash(cache),
+		c.componentFlags.opts,
+	)
+	writeTiming()
+	if err != nil {
 		c.logFatal(err)
 		return
 	}
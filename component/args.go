@@ -0,0 +1,149 @@
+package component
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"xorkevin.dev/anvil/util/kjson"
+	"xorkevin.dev/kerrors"
+)
+
+// normalizeArgs converts args to the types produced by decoding json, so that
+// args from any source are treated identically by config engines
+func normalizeArgs(v any) (any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, kerrors.WithKind(err, ErrInvalidArgs, "Failed to marshal args")
+	}
+	var res any
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, kerrors.WithKind(err, ErrInvalidArgs, "Failed to unmarshal args")
+	}
+	return res, nil
+}
+
+func parseArgsFile(name string) (map[string]any, error) {
+	b, err := os.ReadFile(filepath.FromSlash(name))
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to read args file: %s", name))
+	}
+	var v any
+	switch path.Ext(name) {
+	case ".json":
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, kerrors.WithKind(err, ErrInvalidArgs, fmt.Sprintf("Malformed args file: %s", name))
+		}
+	default:
+		// yaml is a superset of json
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			return nil, kerrors.WithKind(err, ErrInvalidArgs, fmt.Sprintf("Malformed args file: %s", name))
+		}
+	}
+	v, err = normalizeArgs(v)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid args file: %s", name))
+	}
+	args, ok := v.(map[string]any)
+	if !ok {
+		return nil, kerrors.WithKind(nil, ErrInvalidArgs, fmt.Sprintf("Args file must contain an object: %s", name))
+	}
+	return args, nil
+}
+
+// setArg sets a value at a dot separated key path of args. The value is
+// parsed as json if possible, and is otherwise a string.
+func setArg(args map[string]any, kv string) error {
+	key, val, ok := strings.Cut(kv, "=")
+	if !ok {
+		return kerrors.WithKind(nil, ErrInvalidArgs, fmt.Sprintf("Arg must be of the form key.path=value: %s", kv))
+	}
+	var v any
+	if err := json.Unmarshal([]byte(val), &v); err != nil {
+		v = val
+	}
+	segments := strings.Split(key, ".")
+	obj := args
+	for n, i := range segments {
+		if i == "" {
+			return kerrors.WithKind(nil, ErrInvalidArgs, fmt.Sprintf("Invalid arg key path: %s", key))
+		}
+		if n == len(segments)-1 {
+			obj[i] = v
+			break
+		}
+		next, ok := obj[i]
+		if !ok || next == nil {
+			m := map[string]any{}
+			obj[i] = m
+			obj = m
+			continue
+		}
+		m, ok := next.(map[string]any)
+		if !ok {
+			return kerrors.WithKind(nil, ErrInvalidArgs, fmt.Sprintf("Arg %s is not an object in key path: %s", strings.Join(segments[:n+1], "."), key))
+		}
+		obj = m
+	}
+	return nil
+}
+
+type (
+	// RootArgs is a source of root component args
+	RootArgs struct {
+		// Files are json or yaml args files
+		Files []string
+		// Args are merged after files
+		Args map[string]any
+		// Sets are key path values of the form key.path=value applied after
+		// args
+		Sets []string
+	}
+)
+
+// ParseRootArgs returns root component args by merging args files in order
+// followed by key path values of the form key.path=value in order
+func ParseRootArgs(files []string, sets []string) (map[string]any, error) {
+	return MergeRootArgs(RootArgs{
+		Files: files,
+		Sets:  sets,
+	})
+}
+
+// MergeRootArgs returns root component args by merging sources in order. Nil
+// is returned if no source has any args.
+func MergeRootArgs(sources ...RootArgs) (map[string]any, error) {
+	var args map[string]any
+	for _, src := range sources {
+		if len(src.Files) == 0 && src.Args == nil && len(src.Sets) == 0 {
+			continue
+		}
+		if args == nil {
+			args = map[string]any{}
+		}
+		for _, i := range src.Files {
+			fileArgs, err := parseArgsFile(i)
+			if err != nil {
+				return nil, err
+			}
+			args = kjson.MergePatch(args, fileArgs).(map[string]any)
+		}
+		if src.Args != nil {
+			v, err := normalizeArgs(src.Args)
+			if err != nil {
+				return nil, err
+			}
+			args = kjson.MergePatch(args, v).(map[string]any)
+		}
+		for _, i := range src.Sets {
+			if err := setArg(args, i); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return args, nil
+}
@@ -11,52 +11,131 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 
 	"xorkevin.dev/anvil/confengine"
 	"xorkevin.dev/anvil/confengine/gotmplengine"
 	"xorkevin.dev/anvil/confengine/jsonnetengine"
+	"xorkevin.dev/anvil/confengine/starlarkengine"
 	"xorkevin.dev/anvil/confengine/staticfile"
+	"xorkevin.dev/anvil/confengine/yamlengine"
 	"xorkevin.dev/anvil/repofetcher"
 	"xorkevin.dev/anvil/repofetcher/gitfetcher"
 	"xorkevin.dev/anvil/repofetcher/localdir"
 	"xorkevin.dev/anvil/util/kjson"
+	"xorkevin.dev/anvil/util/ktrace"
 	"xorkevin.dev/anvil/util/stackset"
 	"xorkevin.dev/kerrors"
 	"xorkevin.dev/kfs"
 	"xorkevin.dev/klog"
 )
 
-// ErrImportCycle is returned when component dependencies form a cycle
-var ErrImportCycle errImportCycle
+var (
+	// ErrImportCycle is returned when component dependencies form a cycle
+	ErrImportCycle errImportCycle
+	// ErrOutputStale is returned when generated outputs are out of date
+	ErrOutputStale errOutputStale
+	// ErrInvalidOutput is returned when a template output is invalid
+	ErrInvalidOutput errInvalidOutput
+	// ErrOutputCollision is returned when templates write the same output
+	ErrOutputCollision errOutputCollision
+	// ErrInvalidArgs is returned when component args do not match the declared
+	// params of the component
+	ErrInvalidArgs errInvalidArgs
+	// ErrInvalidExports is returned when subcomponent exports are invalid
+	ErrInvalidExports errInvalidExports
+	// ErrImportConflict is returned when a component is imported with
+	// different args that write the same outputs
+	ErrImportConflict errImportConflict
+)
 
 type (
-	errImportCycle struct{}
+	errImportCycle     struct{}
+	errOutputStale     struct{}
+	errInvalidOutput   struct{}
+	errOutputCollision struct{}
+	errInvalidArgs     struct{}
+	errInvalidExports  struct{}
+	errImportConflict  struct{}
 )
 
 func (e errImportCycle) Error() string {
 	return "Import cycle"
 }
 
+func (e errOutputStale) Error() string {
+	return "Output stale"
+}
+
+func (e errInvalidOutput) Error() string {
+	return "Invalid output"
+}
+
+func (e errOutputCollision) Error() string {
+	return "Output collision"
+}
+
+func (e errInvalidArgs) Error() string {
+	return "Invalid component args"
+}
+
+func (e errInvalidExports) Error() string {
+	return "Invalid component exports"
+}
+
+func (e errImportConflict) Error() string {
+	return "Import conflict"
+}
+
+const (
+	repoKindLocalDir   = "localdir"
+	repoKindGit        = "git"
+	configKindJsonnet  = "jsonnet"
+	configKindYAML     = "yaml"
+	configKindJSON     = "json"
+	configKindStarlark = "starlark"
+)
+
 const (
-	repoKindLocalDir  = "localdir"
-	configKindJsonnet = "jsonnet"
+	configFieldComponents = "components"
+)
+
+const (
+	// OutputKindFile is a regular file output
+	OutputKindFile = "file"
+	// OutputKindSymlink is a symlink output
+	OutputKindSymlink = "symlink"
+	// OutputKindDir is a directory output
+	OutputKindDir = "dir"
+)
+
+const (
+	defaultFileMode fs.FileMode = 0o644
+	defaultDirMode  fs.FileMode = 0o777
 )
 
 type (
 	// configData is the shape of a generated config
 	configData struct {
-		Version    string          `json:"version"`
-		Templates  []Template      `json:"templates"`
-		Components []componentData `json:"components"`
+		Version    string           `json:"version"`
+		Params     map[string]Param `json:"params"`
+		Templates  []Template       `json:"templates"`
+		Components []componentData  `json:"components"`
+		Exports    any              `json:"exports"`
+		Hooks      []Hook           `json:"hooks"`
 	}
 
 	// componentData is the shape of a generated config component
 	componentData struct {
-		Kind string          `json:"kind"`
-		Repo json.RawMessage `json:"repo"`
-		Path string          `json:"path"`
-		Args map[string]any  `json:"args"`
+		Name       string          `json:"name"`
+		Kind       string          `json:"kind"`
+		Repo       json.RawMessage `json:"repo"`
+		Path       string          `json:"path"`
+		ConfigKind string          `json:"config_kind"`
+		Args       map[string]any  `json:"args"`
 	}
 
 	// Component is a package of files to generate
@@ -64,68 +143,374 @@ type (
 		Spec      repofetcher.Spec
 		Dir       string
 		Templates []Template
+		Hooks     []Hook
+		node      string
 	}
 
 	// Template is a file to generate
 	Template struct {
-		Kind   string         `json:"kind"`
-		Path   string         `json:"path"`
-		Args   map[string]any `json:"args"`
-		Output string         `json:"output"`
+		Kind       string         `json:"kind"`
+		Path       string         `json:"path"`
+		Args       map[string]any `json:"args"`
+		Output     string         `json:"output"`
+		OutputKind string         `json:"output_kind"`
+		OutputMode string         `json:"output_mode"`
+		LinkTarget string         `json:"link_target"`
+		Overwrite  bool           `json:"overwrite"`
+	}
+)
+
+type (
+	// parser holds state shared while parsing a component tree
+	parser struct {
+		cache  *Cache
+		stderr io.Writer
+		jobs   int
+		sem    chan struct{}
+		graph  *graphBuilder
+		// failures collects failed subcomponents rather than failing the
+		// parse if it is not nil
+		failures *failureSet
+		mu       sync.Mutex
+		// memo holds results by component key and hash of args as imported
+		// so that components imported multiple times with the same args are
+		// parsed once
+		memo map[string]*memoEntry
+		// imports holds the count of in progress imports from an importer
+		// memo key to an imported memo key, which are checked for cycles
+		// before waiting on an in progress parse
+		imports   map[string]map[string]int
+		instances map[string][]componentInstance
+	}
+
+	// memoEntry is the result of parsing a component config with particular
+	// args, which is available once done is closed
+	memoEntry struct {
+		done chan struct{}
+		c    *parsedComponent
+		err  error
+	}
+
+	// componentInstance is a component config imported with particular args
+	componentInstance struct {
+		node       string
+		importPath []string
+		outputs    []string
+	}
+
+	// parsedComponent is the result of parsing a component config and its
+	// subcomponents
+	parsedComponent struct {
+		components []Component
+		exports    any
+		node       string
 	}
 )
 
-func parseConfigFile(ctx context.Context, cache *Cache, spec repofetcher.Spec, dir string, name string, args map[string]any, stderr io.Writer) (_ *configData, retErr error) {
-	eng, err := cache.Get(ctx, configKindJsonnet, spec, dir)
+func newParser(cache *Cache, stderr io.Writer, jobs int, failures *failureSet) *parser {
+	jobs = max(jobs, 1)
+	return &parser{
+		cache:     cache,
+		stderr:    stderr,
+		jobs:      jobs,
+		sem:       make(chan struct{}, jobs),
+		graph:     newGraphBuilder(),
+		failures:  failures,
+		memo:      map[string]*memoEntry{},
+		imports:   map[string]map[string]int{},
+		instances: map[string][]componentInstance{},
+	}
+}
+
+func (p *parser) addImportLocked(from, to string) {
+	m, ok := p.imports[from]
+	if !ok {
+		m = map[string]int{}
+		p.imports[from] = m
+	}
+	m[to]++
+}
+
+func (p *parser) removeImport(from, to string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := p.imports[from]
+	m[to]--
+	if m[to] <= 0 {
+		delete(m, to)
+	}
+	if len(m) == 0 {
+		delete(p.imports, from)
+	}
+}
+
+// importsLocked returns whether from transitively imports to through in
+// progress imports
+func (p *parser) importsLocked(from, to string) bool {
+	visited := map[string]struct{}{}
+	stack := []string{from}
+	for len(stack) > 0 {
+		k := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if k == to {
+			return true
+		}
+		if _, ok := visited[k]; ok {
+			continue
+		}
+		visited[k] = struct{}{}
+		for i := range p.imports[k] {
+			stack = append(stack, i)
+		}
+	}
+	return false
+}
+
+// getMemo returns the memo entry of a memo key imported by parent, and
+// whether the caller is responsible for parsing it and must call
+// [parser.setMemo]. Otherwise the entry is waited on until done. An error is
+// returned if waiting on the entry would wait on an import cycle.
+func (p *parser) getMemo(ctx context.Context, parent, key string) (*memoEntry, bool, error) {
+	p.mu.Lock()
+	entry, ok := p.memo[key]
+	if !ok {
+		entry = &memoEntry{
+			done: make(chan struct{}),
+		}
+		p.memo[key] = entry
+		p.addImportLocked(parent, key)
+		p.mu.Unlock()
+		return entry, true, nil
+	}
+	select {
+	case <-entry.done:
+		p.mu.Unlock()
+		return entry, false, nil
+	default:
+	}
+	if p.importsLocked(key, parent) {
+		p.mu.Unlock()
+		return nil, false, kerrors.WithKind(nil, ErrImportCycle, "Import cycle on in progress import")
+	}
+	p.addImportLocked(parent, key)
+	p.mu.Unlock()
+	defer p.removeImport(parent, key)
+
+	select {
+	case <-ctx.Done():
+		return nil, false, context.Cause(ctx)
+	case <-entry.done:
+		return entry, false, nil
+	}
+}
+
+func (p *parser) setMemo(parent, key string, entry *memoEntry, c *parsedComponent, err error) {
+	p.removeImport(parent, key)
+	entry.c, entry.err = c, err
 	if err != nil {
-		return nil, err
+		p.mu.Lock()
+		// allow failed parses to be retried
+		delete(p.memo, key)
+		p.mu.Unlock()
+	}
+	close(entry.done)
+}
+
+func (p *parser) addInstance(compkey string, instance componentInstance) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, i := range p.instances[compkey] {
+		if i.node == instance.node {
+			// imports with different args may have the same args once
+			// defaults are applied
+			return
+		}
+	}
+	p.instances[compkey] = append(p.instances[compkey], instance)
+}
+
+// execConfig executes a component config and decodes its output into v. If
+// field is not empty, only that field of the config is evaluated, and false is
+// returned if the config engine does not support evaluating fields.
+func (p *parser) execConfig(ctx context.Context, spec repofetcher.Spec, dir string, name string, kind string, args map[string]any, field string, v any) (_ bool, retErr error) {
+	// config files are executed while holding a job slot, and the slot is
+	// released before parsing subcomponents, so nested parsing does not
+	// deadlock
+	select {
+	case <-ctx.Done():
+		return false, context.Cause(ctx)
+	case p.sem <- struct{}{}:
+	}
+	defer func() {
+		<-p.sem
+	}()
+
+	eng, err := p.cache.GetConfig(ctx, kind, spec, dir)
+	if err != nil {
+		return false, err
+	}
+	spanName := fmt.Sprintf("%s %s/%s", spec, dir, name)
+	if field != "" {
+		spanName = fmt.Sprintf("%s [%s]", spanName, field)
+	}
+	defer ktrace.Start(ctx, "parse", spanName)()
+	var out io.ReadCloser
+	if field == "" {
+		out, err = eng.Exec(ctx, name, args, p.stderr)
+	} else {
+		feng, ok := eng.(confengine.FieldEngine)
+		if !ok {
+			return false, nil
+		}
+		out, err = feng.ExecField(ctx, name, field, args, p.stderr)
 	}
-	out, err := eng.Exec(ctx, name, args, stderr)
 	if err != nil {
-		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed executing component config %s %s/%s", spec, dir, name))
+		return false, kerrors.WithMsg(err, fmt.Sprintf("Failed executing component config %s %s/%s", spec, dir, name))
 	}
 	defer func() {
 		if err := out.Close(); err != nil {
 			retErr = errors.Join(retErr, kerrors.WithMsg(err, fmt.Sprintf("Failed to close component config output for %s %s/%s", spec, dir, name)))
 		}
 	}()
-	config := &configData{}
 	dec := json.NewDecoder(out)
-	if err := dec.Decode(&config); err != nil {
-		return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid output for component config %s %s/%s", spec, dir, name))
+	if err := dec.Decode(v); err != nil {
+		return false, kerrors.WithMsg(err, fmt.Sprintf("Invalid output for component config %s %s/%s", spec, dir, name))
+	}
+	return true, nil
+}
+
+// parseConfig executes a full component config and migrates it to the latest
+// schema version
+func (p *parser) parseConfig(ctx context.Context, spec repofetcher.Spec, dir string, name string, kind string, args map[string]any) (*configData, error) {
+	config := &configData{}
+	if _, err := p.execConfig(ctx, spec, dir, name, kind, args, "", config); err != nil {
+		return nil, err
+	}
+	if err := migrateConfig(config); err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid component config %s %s/%s", spec, dir, name))
 	}
 	return config, nil
 }
 
-func parseSubcomponent(ctx context.Context, cache *Cache, ss *stackset.StackSet[string], spec repofetcher.Spec, dir string, data componentData, stderr io.Writer) ([]Component, error) {
-	var compspec repofetcher.Spec
-	var compname string
-	if data.Kind == repoKindLocalDir {
-		return nil, kerrors.WithKind(nil, repofetcher.ErrUnknownKind, fmt.Sprintf("Invalid repo kind: %s", data.Kind))
-	} else if data.Kind == "" {
-		compspec = spec
-		compname = path.Join(dir, data.Path)
-		if !fs.ValidPath(compname) {
-			return nil, kerrors.WithKind(nil, ErrInvalidDir, fmt.Sprintf("Invalid repo dir %s for local subcomponent", data.Path))
+// parseConfigArgs validates args against the declared params of a component
+// config and returns args with defaults applied. parent describes the importer
+// of the component for error messages. Params are read with the args as
+// imported. Configs whose engine cannot evaluate the params field separately
+// are fully evaluated to read their params, and the evaluated config is also
+// returned if applying params does not change the args.
+func (p *parser) parseConfigArgs(ctx context.Context, spec repofetcher.Spec, dir string, name string, kind string, args map[string]any, parent string) (map[string]any, *configData, error) {
+	var params map[string]Param
+	ok, err := p.execConfig(ctx, spec, dir, name, kind, args, paramsField, &params)
+	if err != nil {
+		return nil, nil, kerrors.WithMsg(err, fmt.Sprintf("Failed reading params of component config %s %s/%s", spec, dir, name))
+	}
+	var config *configData
+	if !ok {
+		config, err = p.parseConfig(ctx, spec, dir, name, kind, args)
+		if err != nil {
+			return nil, nil, kerrors.WithMsg(err, fmt.Sprintf("Failed reading params of component config %s %s/%s", spec, dir, name))
 		}
-	} else {
-		var err error
-		compspec, err = cache.Parse(data.Kind, data.Repo)
+		params = config.Params
+	}
+	applied, err := applyParams(params, args)
+	if err != nil {
+		return nil, nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid args passed by %s to component config %s %s/%s", parent, spec, dir, name))
+	}
+	if config != nil {
+		prev, err := argsHash(args)
+		if err != nil {
+			return nil, nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid args passed by %s to component config %s %s/%s", parent, spec, dir, name))
+		}
+		next, err := argsHash(applied)
 		if err != nil {
-			return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid %s subcomponent", data.Kind))
+			return nil, nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid args for component config %s %s/%s", spec, dir, name))
+		}
+		if prev != next {
+			config = nil
+		}
+	}
+	return applied, config, nil
+}
+
+// isFieldEngine returns true if the config engine of a component config can
+// evaluate fields separately
+func (p *parser) isFieldEngine(ctx context.Context, spec repofetcher.Spec, dir string, kind string) (bool, error) {
+	eng, err := p.cache.GetConfig(ctx, kind, spec, dir)
+	if err != nil {
+		return false, err
+	}
+	_, ok := eng.(confengine.FieldEngine)
+	return ok, nil
+}
+
+func hasNamedComponents(components []componentData) bool {
+	for _, i := range components {
+		if i.Name != "" {
+			return true
 		}
-		if !fs.ValidPath(data.Path) {
-			return nil, kerrors.WithKind(nil, ErrInvalidDir, fmt.Sprintf("Invalid repo dir %s for subcomponent %s", data.Path, compspec))
+	}
+	return false
+}
+
+// resolveSubcomponent returns the repo spec and config path of a subcomponent
+// of a component config
+func (p *parser) resolveSubcomponent(ctx context.Context, spec repofetcher.Spec, dir string, data componentData) (repofetcher.Spec, string, error) {
+	if data.Kind == repoKindLocalDir {
+		return repofetcher.Spec{}, "", kerrors.WithKind(nil, repofetcher.ErrUnknownKind, fmt.Sprintf("Invalid repo kind: %s", data.Kind))
+	}
+	if data.Kind == "" {
+		compname := path.Join(dir, data.Path)
+		if !fs.ValidPath(compname) {
+			return repofetcher.Spec{}, "", kerrors.WithKind(nil, ErrInvalidDir, fmt.Sprintf("Invalid repo dir %s for local subcomponent", data.Path))
 		}
-		compname = data.Path
+		return spec, compname, nil
+	}
+	compspec, err := p.cache.Parse(data.Kind, data.Repo)
+	if err != nil {
+		return repofetcher.Spec{}, "", kerrors.WithMsg(err, fmt.Sprintf("Invalid %s subcomponent", data.Kind))
+	}
+	compspec, err = p.cache.Lock(ctx, compspec)
+	if err != nil {
+		return repofetcher.Spec{}, "", kerrors.WithMsg(err, fmt.Sprintf("Invalid %s subcomponent", data.Kind))
 	}
-	c, err := parseComponentsRec(ctx, cache, ss, compspec, compname, data.Args, stderr)
+	if !fs.ValidPath(data.Path) {
+		return repofetcher.Spec{}, "", kerrors.WithKind(nil, ErrInvalidDir, fmt.Sprintf("Invalid repo dir %s for subcomponent %s", data.Path, compspec))
+	}
+	return compspec, data.Path, nil
+}
+
+func (p *parser) parseSubcomponent(ctx context.Context, ss *stackset.StackSet[string], compspec repofetcher.Spec, compname string, key string, data componentData, parent string) (*parsedComponent, error) {
+	c, err := p.parseComponentsRec(ctx, ss, compspec, compname, data.ConfigKind, data.Args, key, parent)
 	if err != nil {
 		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed parsing subcomponent %s %s", compspec, compname))
 	}
 	return c, nil
 }
 
+// configKinds are the config engine kinds of component configs by file
+// extension
+var configKinds = map[string]string{
+	".jsonnet":   configKindJsonnet,
+	".libsonnet": configKindJsonnet,
+	".yaml":      configKindYAML,
+	".yml":       configKindYAML,
+	".json":      configKindJSON,
+	".star":      configKindStarlark,
+}
+
+// configKind returns the config engine kind of a component config, which is
+// the explicit kind if set and otherwise determined by its file extension,
+// defaulting to jsonnet
+func configKind(kind string, name string) string {
+	if kind != "" {
+		return kind
+	}
+	if k, ok := configKinds[path.Ext(name)]; ok {
+		return k
+	}
+	return configKindJsonnet
+}
+
 func componentKey(spec repofetcher.Spec, dir string, name string) string {
 	var s strings.Builder
 	s.WriteString(spec.String())
@@ -134,15 +519,92 @@ func componentKey(spec repofetcher.Spec, dir string, name string) string {
 	return s.String()
 }
 
-func parseComponentsRec(ctx context.Context, cache *Cache, ss *stackset.StackSet[string], spec repofetcher.Spec, name string, args map[string]any, stderr io.Writer) (_ []Component, retErr error) {
+// parseComponentsRec parses a component config and its subcomponents, and
+// returns the components in dependency order along with the exports and graph
+// node of the config. parentKey is the memo key of the importer of the
+// component.
+func (p *parser) parseComponentsRec(ctx context.Context, ss *stackset.StackSet[string], spec repofetcher.Spec, name string, kind string, args map[string]any, parentKey string, parent string) (*parsedComponent, error) {
 	dir, name := path.Split(name)
 	dir = path.Clean(dir)
 	name = path.Clean(name)
+	kind = configKind(kind, name)
+
+	// results are memoized by the args as imported, so that repeated imports
+	// do not evaluate params again
+	hash, err := argsHash(args)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid args passed by %s to component config %s %s/%s", parent, spec, dir, name))
+	}
+	key := graphNodeID(spec, dir, name, hash)
+	entry, owner, err := p.getMemo(ctx, parentKey, key)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed importing component config %s %s/%s", spec, dir, name))
+	}
+	if !owner {
+		return entry.c, entry.err
+	}
+	c, err := p.parseComponentConfig(ctx, ss, spec, dir, name, kind, args, key, parent)
+	p.setMemo(parentKey, key, entry, c, err)
+	return c, err
+}
 
-	config, err := parseConfigFile(ctx, cache, spec, dir, name, args, stderr)
+// parseComponentConfig parses a component config with args and its
+// subcomponents.
+//
+// Configs are evaluated once without exports, which is sufficient unless they
+// name subcomponents. Configs which name subcomponents are evaluated again
+// with the exports of the named subcomponents once they are parsed. If the
+// evaluation without exports fails, only the components field is evaluated to
+// find the named subcomponents when the config engine supports it.
+func (p *parser) parseComponentConfig(ctx context.Context, ss *stackset.StackSet[string], spec repofetcher.Spec, dir string, name string, kind string, args map[string]any, key string, parent string) (_ *parsedComponent, retErr error) {
+	args, config, err := p.parseConfigArgs(ctx, spec, dir, name, kind, args, parent)
 	if err != nil {
 		return nil, err
 	}
+	hash, err := argsHash(args)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid args for component config %s %s/%s", spec, dir, name))
+	}
+	node := graphNodeID(spec, dir, name, hash)
+	p.graph.addNode(GraphNode{
+		ID:       node,
+		Repo:     spec.String(),
+		Dir:      dir,
+		Name:     name,
+		ArgsHash: hash,
+	})
+
+	if config == nil {
+		config, err = p.parseConfig(ctx, spec, dir, name, kind, args)
+	}
+	var subdata []componentData
+	phased := false
+	if err == nil {
+		subdata = config.Components
+		phased = hasNamedComponents(subdata)
+	}
+	if phased || err != nil {
+		fieldEngine, ferr := p.isFieldEngine(ctx, spec, dir, kind)
+		if ferr != nil {
+			return nil, ferr
+		}
+		if !fieldEngine {
+			if err != nil {
+				return nil, err
+			}
+			return nil, kerrors.WithKind(nil, ErrInvalidExports, fmt.Sprintf("Subcomponents in %s %s/%s may only be named by a config kind that may read exports", spec, dir, name))
+		}
+		if err != nil {
+			// the config may have failed because exports were not available
+			if _, ferr := p.execConfig(ctx, spec, dir, name, kind, args, configFieldComponents, &subdata); ferr != nil {
+				return nil, err
+			}
+			if !hasNamedComponents(subdata) {
+				return nil, err
+			}
+			phased = true
+		}
+	}
 
 	compkey := componentKey(spec, dir, name)
 	if !ss.Push(compkey) {
@@ -157,164 +619,732 @@ func parseComponentsRec(ctx context.Context, cache *Cache, ss *stackset.StackSet
 		}
 	}()
 
-	var components []Component
-	for _, i := range config.Components {
-		c, err := parseSubcomponent(ctx, cache, ss, spec, dir, i, stderr)
+	names := map[string]struct{}{}
+	for _, i := range subdata {
+		if i.Name == "" {
+			continue
+		}
+		if _, ok := names[i.Name]; ok {
+			return nil, kerrors.WithKind(nil, ErrInvalidExports, fmt.Sprintf("Duplicate subcomponent name %s in %s %s/%s", i.Name, spec, dir, name))
+		}
+		names[i.Name] = struct{}{}
+	}
+
+	subcomponents := make([]*parsedComponent, len(subdata))
+	if err := runJobs(ctx, p.jobs, len(subdata), func(ctx context.Context, i int) error {
+		subss := ss
+		if p.jobs > 1 {
+			// concurrently parsed subcomponents each require their own import
+			// stack
+			subss = ss.Clone()
+		}
+		// failures are of the subcomponent config once it is resolved, and
+		// otherwise of this config
+		failspec, faildir, failname := spec, dir, name
+		compspec, compname, err := p.resolveSubcomponent(ctx, spec, dir, subdata[i])
+		var c *parsedComponent
+		if err == nil {
+			failspec = compspec
+			faildir, failname = path.Split(compname)
+			faildir, failname = path.Clean(faildir), path.Clean(failname)
+			c, err = p.parseSubcomponent(ctx, subss, compspec, compname, key, subdata[i], fmt.Sprintf("component config %s %s/%s", spec, dir, name))
+		}
+		if err != nil {
+			err = kerrors.WithMsg(err, fmt.Sprintf("Failed parsing subcomponent of %s %s/%s", spec, dir, name))
+			if p.failures == nil {
+				return err
+			}
+			// failed subcomponents are skipped and have no exports
+			p.failures.add(FailureStageParse, failspec, faildir, failname, "", err)
+			return nil
+		}
+		subcomponents[i] = c
+		p.graph.addEdge(node, c.node)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if phased {
+		exports := map[string]any{}
+		for n, i := range subdata {
+			if i.Name != "" && subcomponents[n] != nil {
+				exports[i.Name] = subcomponents[n].exports
+			}
+		}
+		config, err = p.parseConfig(confengine.WithExports(ctx, exports), spec, dir, name, kind, args)
 		if err != nil {
-			return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed parsing subcomponent of %s %s/%s", spec, dir, name))
+			return nil, err
 		}
-		components = append(components, c...)
 	}
 
+	var components []Component
+	included := map[string]struct{}{}
+	for _, i := range subcomponents {
+		if i == nil {
+			continue
+		}
+		for _, j := range i.components {
+			// components imported by multiple subcomponents are only included
+			// once
+			if _, ok := included[j.node]; ok {
+				continue
+			}
+			included[j.node] = struct{}{}
+			components = append(components, j)
+		}
+	}
 	components = append(components, Component{
 		Spec:      spec,
 		Dir:       dir,
 		Templates: config.Templates,
+		Hooks:     config.Hooks,
+		node:      node,
+	})
+	c := &parsedComponent{
+		components: components,
+		exports:    config.Exports,
+		node:       node,
+	}
+	outputs := make([]string, 0, len(config.Templates))
+	for _, i := range config.Templates {
+		outputs = append(outputs, path.Clean(i.Output))
+	}
+	p.addInstance(compkey, componentInstance{
+		node:       node,
+		importPath: ss.Slice(),
+		outputs:    outputs,
 	})
-	return components, nil
+	return c, nil
 }
 
-// ParseComponents parses component configs to [Component]
-func ParseComponents(ctx context.Context, cache *Cache, spec repofetcher.Spec, name string, stderr io.Writer) ([]Component, error) {
-	return parseComponentsRec(ctx, cache, stackset.New[string](), spec, name, nil, stderr)
+// parse parses a root component config
+func (p *parser) parse(ctx context.Context, spec repofetcher.Spec, name string, args map[string]any) (*parsedComponent, error) {
+	return p.parseComponentsRec(ctx, stackset.New[string](), spec, name, "", args, "", "root args")
 }
 
-func writeComponent(ctx context.Context, log *klog.LevelLogger, cache *Cache, fsys fs.FS, component Component, stderr io.Writer, dryrun bool) error {
-	ctx = klog.CtxWithAttrs(ctx, klog.AString("repo", component.Spec.String()), klog.AString("dir", component.Dir))
-	log.Info(ctx, "Writing component")
-	for _, i := range component.Templates {
-		eng, err := cache.Get(ctx, i.Kind, component.Spec, component.Dir)
-		if err != nil {
-			return err
+type (
+	outputOwner struct {
+		spec repofetcher.Spec
+		dir  string
+		path string
+		kind string
+	}
+)
+
+// checkOutputCollisions returns an error if templates write the same output,
+// unless the later template is explicitly marked to overwrite it
+func checkOutputCollisions(components []Component) error {
+	owners := map[string]outputOwner{}
+	for _, i := range components {
+		for _, j := range i.Templates {
+			p := path.Clean(j.Output)
+			if prev, ok := owners[p]; ok && !j.Overwrite {
+				return kerrors.WithKind(nil, ErrOutputCollision, fmt.Sprintf("Output %s of template %s in %s %s collides with template %s in %s %s", p, j.Path, i.Spec, i.Dir, prev.path, prev.spec, prev.dir))
+			}
+			owners[p] = outputOwner{
+				spec: i.Spec,
+				dir:  i.Dir,
+				path: j.Path,
+				kind: j.OutputKind,
+			}
 		}
-		if err := func() (retErr error) {
-			out, err := eng.Exec(ctx, i.Path, i.Args, stderr)
-			if err != nil {
-				return kerrors.WithMsg(err, fmt.Sprintf("Failed executing component template %s %s/%s", component.Spec, component.Dir, i.Path))
+	}
+	// outputs may not be written through symlink outputs
+	paths := make([]string, 0, len(owners))
+	for k := range owners {
+		paths = append(paths, k)
+	}
+	slices.Sort(paths)
+	for _, p := range paths {
+		for d := path.Dir(p); d != "." && d != "/"; d = path.Dir(d) {
+			if link, ok := owners[d]; ok && link.kind == OutputKindSymlink {
+				o := owners[p]
+				return kerrors.WithKind(nil, ErrOutputCollision, fmt.Sprintf("Output %s of template %s in %s %s is inside symlink output %s of %s %s", p, o.path, o.spec, o.dir, d, link.spec, link.dir))
 			}
-			defer func() {
-				if err := out.Close(); err != nil {
-					retErr = errors.Join(retErr, kerrors.WithMsg(err, fmt.Sprintf("Failed to close component template %s %s/%s", component.Spec, component.Dir, i.Path)))
-				}
-			}()
-			if dryrun {
-				log.Info(ctx, "Dry run write template", klog.AString("path", i.Path), klog.AString("output", i.Output))
-			} else {
-				f, err := kfs.OpenFile(fsys, i.Output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
-				if err != nil {
-					return kerrors.WithMsg(err, fmt.Sprintf("Failed opening component template output %s for %s %s/%s", i.Output, component.Spec, component.Dir, i.Path))
-				}
-				defer func() {
-					if err := f.Close(); err != nil {
-						retErr = errors.Join(retErr, kerrors.WithMsg(err, fmt.Sprintf("Failed closing component template output %s for %s %s/%s", i.Output, component.Spec, component.Dir, i.Path)))
+		}
+	}
+	return nil
+}
+
+// checkImportConflicts returns an error if a component config is imported with
+// different args that write the same outputs
+func (p *parser) checkImportConflicts() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys := make([]string, 0, len(p.instances))
+	for k := range p.instances {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		instances := slices.Clone(p.instances[k])
+		slices.SortFunc(instances, func(a, b componentInstance) int {
+			return strings.Compare(a.node, b.node)
+		})
+		for n, i := range instances {
+			outputs := map[string]struct{}{}
+			for _, j := range i.outputs {
+				outputs[j] = struct{}{}
+			}
+			for _, j := range instances[n+1:] {
+				for _, o := range j.outputs {
+					if _, ok := outputs[o]; ok {
+						return kerrors.WithKind(nil, ErrImportConflict, fmt.Sprintf("Component %s imported with conflicting args writing output %s by %s and by %s", k, o, strings.Join(i.importPath, " -> "), strings.Join(j.importPath, " -> ")))
 					}
-				}()
-				if _, err := io.Copy(f, out); err != nil {
-					return kerrors.WithMsg(err, fmt.Sprintf("Failed writing component template output %s for %s %s/%s", i.Output, component.Spec, component.Dir, i.Path))
 				}
-				log.Info(ctx, "Wrote template", klog.AString("path", i.Path), klog.AString("output", i.Output))
 			}
-			return nil
-		}(); err != nil {
-			return err
 		}
 	}
 	return nil
 }
 
-// WriteComponents writes components to an fs
-func WriteComponents(ctx context.Context, log klog.Logger, cache *Cache, fsys fs.FS, components []Component, stderr io.Writer, dryrun bool) error {
-	l := klog.NewLevelLogger(log)
-	for _, i := range components {
-		if err := writeComponent(ctx, l, cache, fsys, i, stderr, dryrun); err != nil {
-			return err
-		}
+// ParseComponents parses component configs to [Component] with at most jobs
+// configs parsed concurrently
+func ParseComponents(ctx context.Context, cache *Cache, spec repofetcher.Spec, name string, args map[string]any, stderr io.Writer, jobs int) ([]Component, error) {
+	return parseComponents(ctx, cache, spec, name, args, stderr, jobs, nil)
+}
+
+// parseComponents parses component configs, collecting failed subcomponents
+// into failures if it is not nil
+func parseComponents(ctx context.Context, cache *Cache, spec repofetcher.Spec, name string, args map[string]any, stderr io.Writer, jobs int, failures *failureSet) ([]Component, error) {
+	p := newParser(cache, stderr, jobs, failures)
+	c, err := p.parse(ctx, spec, name, args)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	if err := p.checkImportConflicts(); err != nil {
+		return nil, err
+	}
+	if err := checkOutputCollisions(c.components); err != nil {
+		return nil, err
+	}
+	return c.components, nil
 }
 
 type (
-	// Opts holds generation opts
-	Opts struct {
-		DryRun           bool
-		NoNetwork        bool
-		ForceFetch       bool
-		RepoChecksumFile string
-		GitDir           string
-		GitBin           string
-		GitBinQuiet      bool
-		JsonnetLibName   string
+	// Output is a rendered component template
+	Output struct {
+		Spec     repofetcher.Spec
+		Dir      string
+		Template Template
+		Kind     string
+		Mode     fs.FileMode
+		ModeSet  bool
+		Data     []byte
+		// HookSkipped is set if a hook matching the output was listed rather
+		// than run, so the output data is not final
+		HookSkipped bool
 	}
+)
 
-	// RepoChecksumData is the shape of a repo checksum file
-	RepoChecksumData struct {
-		Repos []repofetcher.RepoChecksum `json:"repos"`
+func parseOutputMode(mode string) (fs.FileMode, bool, error) {
+	if mode == "" {
+		return 0, false, nil
 	}
-)
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, false, kerrors.WithKind(err, ErrInvalidOutput, fmt.Sprintf("Invalid output mode %s", mode))
+	}
+	if fs.FileMode(m)&^fs.ModePerm != 0 {
+		return 0, false, kerrors.WithKind(nil, ErrInvalidOutput, fmt.Sprintf("Output mode %s may only contain permission bits", mode))
+	}
+	return fs.FileMode(m), true, nil
+}
 
-func parseRepoChecksumFile(name string) (map[string]string, error) {
-	b, err := os.ReadFile(filepath.FromSlash(name))
+func renderTemplate(ctx context.Context, cache *Cache, component Component, tmpl Template, stderr io.Writer) (_ []byte, retErr error) {
+	eng, err := cache.Get(ctx, tmpl.Kind, component.Spec, component.Dir)
 	if err != nil {
-		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to read repo checksum file: %s", name))
+		return nil, err
 	}
-	var data RepoChecksumData
-	if err := kjson.Unmarshal(b, &data); err != nil {
-		return nil, kerrors.WithMsg(err, fmt.Sprintf("Malformed repo checksum file: %s", name))
+	defer ktrace.Start(ctx, "render", fmt.Sprintf("%s %s/%s", component.Spec, component.Dir, tmpl.Path))()
+	out, err := eng.Exec(ctx, tmpl.Path, tmpl.Args, stderr)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed executing component template %s %s/%s", component.Spec, component.Dir, tmpl.Path))
 	}
-	res := map[string]string{}
-	for _, i := range data.Repos {
-		res[i.Key] = i.Sum
+	defer func() {
+		if err := out.Close(); err != nil {
+			retErr = errors.Join(retErr, kerrors.WithMsg(err, fmt.Sprintf("Failed to close component template %s %s/%s", component.Spec, component.Dir, tmpl.Path)))
+		}
+	}()
+	b, err := io.ReadAll(out)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed reading component template output %s for %s %s/%s", tmpl.Output, component.Spec, component.Dir, tmpl.Path))
 	}
-	return res, nil
+	return b, nil
 }
 
-func writeRepoChecksumFile(name string, repos []repofetcher.RepoChecksum) error {
-	b, err := kjson.Marshal(RepoChecksumData{
-		Repos: repos,
-	})
+func renderOutput(ctx context.Context, cache *Cache, component Component, tmpl Template, stderr io.Writer) (*Output, error) {
+	mode, modeSet, err := parseOutputMode(tmpl.OutputMode)
 	if err != nil {
-		return kerrors.WithMsg(err, "Failed to construct repo checksum data")
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid output %s for %s %s", tmpl.Output, component.Spec, component.Dir))
 	}
-	var f bytes.Buffer
-	if err := json.Indent(&f, b, "", "  "); err != nil {
-		return kerrors.WithMsg(err, "Failed to indent repo checksum file")
+	output := &Output{
+		Spec:     component.Spec,
+		Dir:      component.Dir,
+		Template: tmpl,
+		Mode:     mode,
+		ModeSet:  modeSet,
 	}
-	if err := os.WriteFile(filepath.FromSlash(name), f.Bytes(), 0o644); err != nil {
-		return kerrors.WithMsg(err, fmt.Sprintf("Failed to write repo checksum file: %s", name))
+	switch tmpl.OutputKind {
+	case "", OutputKindFile:
+		output.Kind = OutputKindFile
+		if !modeSet {
+			output.Mode = defaultFileMode
+		}
+		b, err := renderTemplate(ctx, cache, component, tmpl, stderr)
+		if err != nil {
+			return nil, err
+		}
+		output.Data = b
+	case OutputKindSymlink:
+		output.Kind = OutputKindSymlink
+		if modeSet {
+			return nil, kerrors.WithKind(nil, ErrInvalidOutput, fmt.Sprintf("Symlink output %s for %s %s may not have a mode", tmpl.Output, component.Spec, component.Dir))
+		}
+		if tmpl.LinkTarget == "" {
+			return nil, kerrors.WithKind(nil, ErrInvalidOutput, fmt.Sprintf("Symlink output %s for %s %s is missing a link target", tmpl.Output, component.Spec, component.Dir))
+		}
+		if err := checkLinkTarget(tmpl.Output, tmpl.LinkTarget); err != nil {
+			return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid symlink output for %s %s", component.Spec, component.Dir))
+		}
+		output.Data = []byte(tmpl.LinkTarget)
+	case OutputKindDir:
+		output.Kind = OutputKindDir
+		if !modeSet {
+			output.Mode = defaultDirMode
+		}
+	default:
+		return nil, kerrors.WithKind(nil, ErrInvalidOutput, fmt.Sprintf("Invalid output kind %s for output %s for %s %s", tmpl.OutputKind, tmpl.Output, component.Spec, component.Dir))
 	}
-	return nil
+	return output, nil
 }
 
-// Generate reads configs and writes components to the filesystem
-func Generate(ctx context.Context, log klog.Logger, output, input, cachedir string, opts Opts) error {
-	l := klog.NewLevelLogger(log)
+type (
+	componentTemplate struct {
+		component int
+		template  Template
+	}
+)
 
-	var checksums map[string]string
-	if opts.RepoChecksumFile != "" {
-		var err error
-		checksums, err = parseRepoChecksumFile(opts.RepoChecksumFile)
+// RenderComponents renders component templates with at most jobs templates
+// rendered concurrently. Outputs are returned in component order.
+func RenderComponents(ctx context.Context, log klog.Logger, cache *Cache, components []Component, stderr io.Writer, jobs int) ([]Output, error) {
+	return renderComponents(ctx, log, cache, components, stderr, jobs, nil)
+}
+
+// renderComponents renders component templates, collecting failed templates
+// into failures if it is not nil. Failed templates have no output.
+func renderComponents(ctx context.Context, log klog.Logger, cache *Cache, components []Component, stderr io.Writer, jobs int, failures *failureSet) ([]Output, error) {
+	l := klog.NewLevelLogger(log)
+	var templates []componentTemplate
+	for n, i := range components {
+		for _, j := range i.Templates {
+			templates = append(templates, componentTemplate{
+				component: n,
+				template:  j,
+			})
+		}
+	}
+	outputs := make([]*Output, len(templates))
+	if err := runJobs(ctx, jobs, len(templates), func(ctx context.Context, i int) error {
+		component := components[templates[i].component]
+		tmpl := templates[i].template
+		ctx = klog.CtxWithAttrs(ctx, klog.AString("repo", component.Spec.String()), klog.AString("dir", component.Dir))
+		o, err := renderOutput(ctx, cache, component, tmpl, stderr)
 		if err != nil {
-			if !errors.Is(err, fs.ErrNotExist) {
+			if failures == nil {
 				return err
 			}
-			// file does not exist
-			checksums = nil
-			l.Info(ctx, "Repo checksum file not found", klog.AString("file", opts.RepoChecksumFile))
-		} else {
-			l.Info(ctx, "Using existing repo checksum file", klog.AString("file", opts.RepoChecksumFile))
+			failures.add(FailureStageRender, component.Spec, component.Dir, tmpl.Path, tmpl.Output, err)
+			return nil
+		}
+		l.Debug(ctx, "Rendered template", klog.AString("path", tmpl.Path), klog.AString("output", tmpl.Output))
+		outputs[i] = o
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	res := make([]Output, 0, len(outputs))
+	for _, i := range outputs {
+		if i != nil {
+			res = append(res, *i)
 		}
 	}
+	return res, nil
+}
 
-	local, name := path.Split(input)
-	local = path.Clean(local)
-	name = path.Clean(name)
-	gitdir := path.Join(cachedir, "repos", "git")
+func lstatOutput(fsys fs.FS, name string) (fs.FileInfo, error) {
+	info, err := kfs.Lstat(fsys, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to stat existing output %s", name))
+	}
+	return info, nil
+}
+
+func writeFileOutput(fsys fs.FS, output Output) (retErr error) {
+	name := output.Template.Output
+	info, err := lstatOutput(fsys, name)
+	if err != nil {
+		return err
+	}
+	if info != nil && (!info.Mode().IsRegular() || output.ModeSet && info.Mode().Perm() != output.Mode) {
+		// file mode is only applied on creation, so the existing entry must be
+		// replaced
+		if err := kfs.Remove(fsys, name); err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Failed removing existing output %s", name))
+		}
+	}
+	f, err := kfs.OpenFile(fsys, name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, output.Mode)
+	if err != nil {
+		return kerrors.WithMsg(err, fmt.Sprintf("Failed opening component template output %s for %s %s/%s", name, output.Spec, output.Dir, output.Template.Path))
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			retErr = errors.Join(retErr, kerrors.WithMsg(err, fmt.Sprintf("Failed closing component template output %s for %s %s/%s", name, output.Spec, output.Dir, output.Template.Path)))
+		}
+	}()
+	if _, err := f.Write(output.Data); err != nil {
+		return kerrors.WithMsg(err, fmt.Sprintf("Failed writing component template output %s for %s %s/%s", name, output.Spec, output.Dir, output.Template.Path))
+	}
+	return nil
+}
+
+// checkLinkTarget returns an error if a symlink output target is absolute or
+// resolves outside of the output dir
+func checkLinkTarget(output, target string) error {
+	if path.IsAbs(target) || filepath.IsAbs(target) {
+		return kerrors.WithKind(nil, ErrInvalidOutput, fmt.Sprintf("Symlink output %s may not have an absolute link target %s", output, target))
+	}
+	if p := path.Join(path.Dir(path.Clean(output)), target); p == ".." || strings.HasPrefix(p, "../") {
+		return kerrors.WithKind(nil, ErrInvalidOutput, fmt.Sprintf("Symlink output %s link target %s is outside the output dir", output, target))
+	}
+	return nil
+}
+
+func writeSymlinkOutput(fsys fs.FS, output Output) error {
+	name := output.Template.Output
+	target := string(output.Data)
+	if err := checkLinkTarget(name, target); err != nil {
+		return err
+	}
+	info, err := lstatOutput(fsys, name)
+	if err != nil {
+		return err
+	}
+	if info != nil {
+		if info.Mode()&fs.ModeSymlink != 0 {
+			existing, err := kfs.ReadLink(fsys, name)
+			if err != nil {
+				return kerrors.WithMsg(err, fmt.Sprintf("Failed reading existing symlink output %s", name))
+			}
+			if existing == target {
+				return nil
+			}
+		}
+		if err := kfs.Remove(fsys, name); err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Failed removing existing output %s", name))
+		}
+	}
+	if dir := path.Dir(name); dir != "." {
+		if err := kfs.MkdirAll(fsys, dir, defaultDirMode); err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Failed creating dir for symlink output %s", name))
+		}
+	}
+	if err := kfs.Symlink(fsys, target, name); err != nil {
+		return kerrors.WithMsg(err, fmt.Sprintf("Failed creating symlink output %s for %s %s", name, output.Spec, output.Dir))
+	}
+	return nil
+}
+
+func writeDirOutput(fsys fs.FS, output Output) error {
+	name := output.Template.Output
+	info, err := lstatOutput(fsys, name)
+	if err != nil {
+		return err
+	}
+	if info != nil {
+		if info.IsDir() {
+			return nil
+		}
+		if err := kfs.Remove(fsys, name); err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Failed removing existing output %s", name))
+		}
+	}
+	if err := kfs.MkdirAll(fsys, name, output.Mode); err != nil {
+		return kerrors.WithMsg(err, fmt.Sprintf("Failed creating dir output %s for %s %s", name, output.Spec, output.Dir))
+	}
+	return nil
+}
+
+func writeOutput(ctx context.Context, log *klog.LevelLogger, fsys fs.FS, output Output, dryrun bool) error {
+	ctx = klog.CtxWithAttrs(ctx, klog.AString("repo", output.Spec.String()), klog.AString("dir", output.Dir))
+	attrs := []klog.Attr{
+		klog.AString("path", output.Template.Path),
+		klog.AString("output", output.Template.Output),
+		klog.AString("kind", output.Kind),
+	}
+	if output.ModeSet {
+		attrs = append(attrs, klog.AString("mode", fmt.Sprintf("%04o", output.Mode)))
+	}
+	if dryrun {
+		log.Info(ctx, "Dry run write template", attrs...)
+		return nil
+	}
+	switch output.Kind {
+	case OutputKindSymlink:
+		if err := writeSymlinkOutput(fsys, output); err != nil {
+			return err
+		}
+	case OutputKindDir:
+		if err := writeDirOutput(fsys, output); err != nil {
+			return err
+		}
+	default:
+		if err := writeFileOutput(fsys, output); err != nil {
+			return err
+		}
+	}
+	log.Info(ctx, "Wrote template", attrs...)
+	return nil
+}
+
+type (
+	// outputStats counts the changes made by writing outputs
+	outputStats struct {
+		created   int
+		updated   int
+		unchanged int
+	}
+)
+
+func (s *outputStats) add(change string) {
+	switch change {
+	case OutputChangeCreate:
+		s.created++
+	case OutputChangeUpdate:
+		s.updated++
+	default:
+		s.unchanged++
+	}
+}
+
+func (s *outputStats) attrs() []klog.Attr {
+	return []klog.Attr{
+		klog.AInt("new", s.created),
+		klog.AInt("updated", s.updated),
+		klog.AInt("unchanged", s.unchanged),
+	}
+}
+
+// logUnchangedOutput logs an output that is left untouched because it is
+// identical to the existing entry
+func logUnchangedOutput(ctx context.Context, log *klog.LevelLogger, output Output, existing *existingOutput) {
+	if output.Kind == OutputKindDir && output.ModeSet && existing.mode != output.Mode {
+		log.Warn(ctx, "Dir output mode is only applied on creation", klog.AString("output", output.Template.Output), klog.AString("mode", fmt.Sprintf("%04o", existing.mode)))
+	}
+	log.Debug(ctx, "Unchanged template output", klog.AString("path", output.Template.Path), klog.AString("output", output.Template.Output))
+}
+
+// writeOutputs writes outputs to an fs, skipping outputs that are identical to
+// the existing entries so that their mtimes are preserved
+func writeOutputs(ctx context.Context, log *klog.LevelLogger, fsys fs.FS, outputs []Output, dryrun bool) (*outputStats, error) {
+	stats := &outputStats{}
+	for _, i := range outputs {
+		change, existing, err := outputChange(fsys, i)
+		if err != nil {
+			return nil, err
+		}
+		stats.add(change)
+		if change == "" {
+			logUnchangedOutput(ctx, log, i, existing)
+			continue
+		}
+		if err := writeOutput(ctx, log, fsys, i, dryrun); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// WriteOutputs writes rendered outputs to an fs
+func WriteOutputs(ctx context.Context, log klog.Logger, fsys fs.FS, outputs []Output, dryrun bool) error {
+	l := klog.NewLevelLogger(log)
+	stats, err := writeOutputs(ctx, l, fsys, outputs, dryrun)
+	if err != nil {
+		return err
+	}
+	if dryrun {
+		l.Info(ctx, "Dry run write outputs", stats.attrs()...)
+	} else {
+		l.Info(ctx, "Wrote outputs", stats.attrs()...)
+	}
+	return nil
+}
+
+// WriteComponents writes components to an fs
+func WriteComponents(ctx context.Context, log klog.Logger, cache *Cache, fsys fs.FS, components []Component, stderr io.Writer, jobs int, dryrun bool) error {
+	outputs, err := RenderComponents(ctx, log, cache, components, stderr, jobs)
+	if err != nil {
+		return err
+	}
+	return WriteOutputs(ctx, log, fsys, outputs, dryrun)
+}
+
+type (
+	// Opts holds generation opts
+	Opts struct {
+		DryRun           bool
+		Check            bool
+		Jobs             int
+		NoNetwork        bool
+		ForceFetch       bool
+		RepoChecksumFile string
+		ManifestFile     string
+		GitDir           string
+		GitBin           string
+		GitBinQuiet      bool
+		JsonnetLibName   string
+		ArgsFiles        []string
+		Args             []string
+		OverrideFile     string
+		Replace          []string
+		NoHooks          bool
+		AllowRemoteHooks bool
+		ProvenanceFile   string
+		GeneratedHeaders bool
+		// UpdateLocks resolves floating repo specs again rather than using
+		// their existing locks
+		UpdateLocks bool
+		// RepoSumStrict requires every non-local repo to have an existing
+		// checksum, and reports unused checksums rather than rewriting the repo
+		// checksum file
+		RepoSumStrict bool
+		// KeepGoing collects failed subcomponents and templates and generates
+		// the remaining components rather than stopping at the first failure
+		KeepGoing bool
+		// FailureReportFile is written with the failures collected in keep
+		// going mode if set
+		FailureReportFile string
+		// Sink receives outputs instead of the output dir if set. Stale outputs
+		// are not pruned, and the manifest is not written.
+		Sink Sink
+	}
+
+	// RepoChecksumData is the shape of a repo checksum file
+	RepoChecksumData struct {
+		Repos []repofetcher.RepoChecksum `json:"repos"`
+		Locks []repofetcher.RepoLock     `json:"locks,omitempty"`
+	}
+
+	// repoSums are repo checksums and floating repo locks by key
+	repoSums struct {
+		checksums map[string]string
+		locks     map[string]string
+	}
+)
+
+func parseRepoChecksumFile(name string) (*repoSums, error) {
+	b, err := os.ReadFile(filepath.FromSlash(name))
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to read repo checksum file: %s", name))
+	}
+	var data RepoChecksumData
+	if err := kjson.Unmarshal(b, &data); err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Malformed repo checksum file: %s", name))
+	}
+	res := &repoSums{
+		checksums: map[string]string{},
+		locks:     map[string]string{},
+	}
+	for _, i := range data.Repos {
+		res.checksums[i.Key] = i.Sum
+	}
+	for _, i := range data.Locks {
+		res.locks[i.Key] = i.Lock
+	}
+	return res, nil
+}
+
+func writeRepoChecksumFile(name string, repos []repofetcher.RepoChecksum, locks []repofetcher.RepoLock) error {
+	b, err := kjson.Marshal(RepoChecksumData{
+		Repos: repos,
+		Locks: locks,
+	})
+	if err != nil {
+		return kerrors.WithMsg(err, "Failed to construct repo checksum data")
+	}
+	var f bytes.Buffer
+	if err := json.Indent(&f, b, "", "  "); err != nil {
+		return kerrors.WithMsg(err, "Failed to indent repo checksum file")
+	}
+	if err := os.WriteFile(filepath.FromSlash(name), f.Bytes(), 0o644); err != nil {
+		return kerrors.WithMsg(err, fmt.Sprintf("Failed to write repo checksum file: %s", name))
+	}
+	return nil
+}
 
-	cache := NewCache(
+func readRepoChecksums(ctx context.Context, log *klog.LevelLogger, opts Opts) (*repoSums, error) {
+	if opts.RepoChecksumFile == "" {
+		return &repoSums{}, nil
+	}
+	checksums, err := parseRepoChecksumFile(opts.RepoChecksumFile)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		// file does not exist
+		log.Info(ctx, "Repo checksum file not found", klog.AString("file", opts.RepoChecksumFile))
+		return &repoSums{}, nil
+	}
+	log.Info(ctx, "Using existing repo checksum file", klog.AString("file", opts.RepoChecksumFile))
+	return checksums, nil
+}
+
+func readManifest(ctx context.Context, log *klog.LevelLogger, opts Opts) (*ManifestData, error) {
+	if opts.ManifestFile == "" {
+		return nil, nil
+	}
+	manifest, err := parseManifestFile(opts.ManifestFile)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		// file does not exist
+		log.Info(ctx, "Manifest file not found", klog.AString("file", opts.ManifestFile))
+		return nil, nil
+	}
+	log.Info(ctx, "Using existing manifest file", klog.AString("file", opts.ManifestFile))
+	return manifest, nil
+}
+
+// prevOutputs returns the previously generated outputs of the manifest if it
+// was generated for the same output dir
+func prevOutputs(ctx context.Context, log *klog.LevelLogger, manifest *ManifestData, output string, opts Opts) []string {
+	if manifest == nil {
+		return nil
+	}
+	if manifest.Output != output {
+		log.Warn(ctx, "Ignoring manifest outputs for different output dir", klog.AString("file", opts.ManifestFile), klog.AString("output", manifest.Output))
+		return nil
+	}
+	return manifest.Outputs
+}
+
+func newGenerateCache(ctx context.Context, log klog.Logger, local string, cachedir string, sums *repoSums, opts Opts) (*Cache, error) {
+	replace, err := readReplacements(ctx, klog.NewLevelLogger(log), opts)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, "Invalid repo replacements")
+	}
+	gitdir := path.Join(cachedir, "repos", "git")
+	return NewCache(
 		repofetcher.NewCache(
 			repofetcher.Map{
 				repoKindLocalDir: localdir.New(kfs.NewReadOnlyFS(kfs.DirFS(local))),
-				"git": gitfetcher.New(
+				repoKindGit: gitfetcher.New(
 					kfs.NewReadOnlyFS(kfs.DirFS(gitdir)),
 					log.Sublogger("gitfetcher"),
 					gitfetcher.OptGitDir(opts.GitDir),
@@ -330,40 +1360,336 @@ func Generate(ctx context.Context, log klog.Logger, output, input, cachedir stri
 			map[string]struct{}{
 				repoKindLocalDir: {},
 			},
-			checksums,
+			sums.checksums,
+			repofetcher.OptReplacements(replace),
+			repofetcher.OptLocks(sums.locks, opts.UpdateLocks),
+			repofetcher.OptStrict(opts.RepoSumStrict),
+			repofetcher.OptLog(log.Sublogger("repofetcher")),
 		),
 		confengine.Map{
-			configKindJsonnet: jsonnetengine.Builder{jsonnetengine.OptLibName(opts.JsonnetLibName)},
-			"jsonnetstr":      jsonnetengine.Builder{jsonnetengine.OptLibName(opts.JsonnetLibName), jsonnetengine.OptStrOut(true)},
-			"staticfile":      staticfile.Builder{},
-			"gotmpl":          gotmplengine.Builder{},
+			"jsonnet":    jsonnetengine.Builder{jsonnetengine.OptLibName(opts.JsonnetLibName)},
+			"jsonnetstr": jsonnetengine.Builder{jsonnetengine.OptLibName(opts.JsonnetLibName), jsonnetengine.OptStrOut(true)},
+			"staticfile": staticfile.Builder{},
+			"gotmpl":     gotmplengine.Builder{},
 		},
-	)
+		confengine.Map{
+			configKindJsonnet:  jsonnetengine.Builder{jsonnetengine.OptLibName(opts.JsonnetLibName)},
+			configKindYAML:     yamlengine.Builder{},
+			configKindJSON:     yamlengine.Builder{},
+			configKindStarlark: starlarkengine.Builder{starlarkengine.OptLibName(opts.JsonnetLibName)},
+		},
+	), nil
+}
+
+func parseInput(ctx context.Context, log klog.Logger, input, cachedir string, sums *repoSums, opts Opts, failures *failureSet) (*Cache, []Component, error) {
+	local, name := path.Split(input)
+	local = path.Clean(local)
+	name = path.Clean(name)
+
+	args, err := ParseRootArgs(opts.ArgsFiles, opts.Args)
+	if err != nil {
+		return nil, nil, kerrors.WithMsg(err, "Invalid root component args")
+	}
+
+	cache, err := newGenerateCache(ctx, log, local, cachedir, sums, opts)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	components, err := ParseComponents(
+	components, err := parseComponents(
 		ctx,
 		cache,
 		repofetcher.Spec{Kind: repoKindLocalDir, RepoSpec: localdir.RepoSpec{}},
 		name,
+		args,
 		os.Stderr,
+		opts.Jobs,
+		failures,
 	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cache, components, nil
+}
+
+// Generate reads configs and writes components to the filesystem
+func Generate(ctx context.Context, log klog.Logger, output, input, cachedir string, opts Opts) error {
+	_, _, err := generate(ctx, log, output, input, cachedir, opts)
+	return err
+}
+
+// generate writes components to the filesystem and returns the parsed
+// components, which are returned even if writing them fails
+func generate(ctx context.Context, log klog.Logger, output, input, cachedir string, opts Opts) (*Cache, []Component, error) {
+	l := klog.NewLevelLogger(log)
+
+	sums, err := readRepoChecksums(ctx, l, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var failures *failureSet
+	if opts.KeepGoing {
+		failures = newFailureSet()
+	}
+
+	cache, components, err := parseInput(ctx, log, input, cachedir, sums, opts, failures)
+	if err != nil {
+		// failures collected before the root config failed are still reported
+		return nil, nil, errors.Join(err, reportFailures(ctx, l, failures, opts))
+	}
+
+	if err := writeComponents(ctx, l, output, cache, components, opts, failures); err != nil {
+		return cache, components, errors.Join(err, reportFailures(ctx, l, failures, opts))
+	}
+	if failures.len() == 0 {
+		// repos of failed subcomponents may be missing from the cache
+		if err := writeRepoChecksums(ctx, l, cache, opts); err != nil {
+			return cache, components, err
+		}
+	}
+	if err := reportFailures(ctx, l, failures, opts); err != nil {
+		return cache, components, err
+	}
+	return cache, components, nil
+}
+
+// writeComponents renders parsed components and writes them to the output
+// along with their provenance and manifest. If any failures are collected,
+// only the rendered outputs are written, and stale outputs are not pruned.
+func writeComponents(ctx context.Context, l *klog.LevelLogger, output string, cache *Cache, components []Component, opts Opts, failures *failureSet) error {
+	manifest, err := readManifest(ctx, l, opts)
 	if err != nil {
 		return err
 	}
 
-	if opts.RepoChecksumFile != "" {
+	if opts.Check {
+		return checkComponents(ctx, l, cache, kfs.DirFS(output), components, prevOutputs(ctx, l, manifest, output, opts), opts, failures)
+	}
+
+	outputs, err := renderOutputs(ctx, l.Logger, cache, components, opts, failures)
+	if err != nil {
+		return err
+	}
+	if opts.Sink != nil {
+		if err := writeOutputsSink(ctx, l, opts.Sink, outputs, opts.DryRun); err != nil {
+			return err
+		}
+		return writeProvenance(ctx, l, cache, outputs, opts)
+	}
+
+	failed := failures.len() > 0
+	var stale []string
+	if opts.ManifestFile != "" && !failed {
+		stale = StaleOutputs(prevOutputs(ctx, l, manifest, output, opts), ComponentOutputs(components))
+	}
+	if err := writeOutputsDir(ctx, l, output, outputs, stale, opts.DryRun); err != nil {
+		return err
+	}
+	if failed {
+		l.Warn(ctx, "Skipping manifest due to generation failures")
+		return writeProvenance(ctx, l, cache, outputs, opts)
+	}
+
+	if err := writeProvenance(ctx, l, cache, outputs, opts); err != nil {
+		return err
+	}
+
+	if opts.ManifestFile != "" {
 		if opts.DryRun {
-			l.Info(ctx, "Dry run write repo sum file", klog.AString("file", opts.RepoChecksumFile))
+			l.Info(ctx, "Dry run write manifest file", klog.AString("file", opts.ManifestFile))
 		} else {
-			if err := writeRepoChecksumFile(opts.RepoChecksumFile, cache.repos.Sums()); err != nil {
-				return kerrors.WithMsg(err, fmt.Sprintf("Failed writing repo sum file: %s", opts.RepoChecksumFile))
+			if err := writeManifestFile(opts.ManifestFile, ManifestData{
+				Output:  output,
+				Outputs: ComponentOutputs(components),
+			}); err != nil {
+				return kerrors.WithMsg(err, fmt.Sprintf("Failed writing manifest file: %s", opts.ManifestFile))
 			}
-			l.Info(ctx, "Wrote repo sum file", klog.AString("file", opts.RepoChecksumFile))
+			l.Info(ctx, "Wrote manifest file", klog.AString("file", opts.ManifestFile))
 		}
 	}
+	return nil
+}
+
+// writeOutputsDir writes outputs to the output dir and prunes stale outputs
+func writeOutputsDir(ctx context.Context, l *klog.LevelLogger, output string, outputs []Output, stale []string, dryrun bool) error {
+	defer ktrace.Start(ctx, "write", output)()
+	if dryrun {
+		outputfs := kfs.DirFS(output)
+		if err := WriteOutputs(ctx, l.Logger, outputfs, outputs, true); err != nil {
+			return err
+		}
+		if err := PruneOutputs(ctx, l.Logger, outputfs, stale, nil, true); err != nil {
+			return err
+		}
+		return nil
+	}
+	// outputs are staged so that the output dir is left untouched if any
+	// output fails to be written
+	return writeOutputsStaged(ctx, l, output, outputs, stale)
+}
+
+func writeRepoChecksums(ctx context.Context, l *klog.LevelLogger, cache *Cache, opts Opts) error {
+	if opts.RepoSumStrict {
+		reportUnusedRepoChecksums(ctx, l, cache, opts)
+		return nil
+	}
+	if opts.RepoChecksumFile == "" || opts.Check {
+		return nil
+	}
+	if opts.DryRun {
+		l.Info(ctx, "Dry run write repo sum file", klog.AString("file", opts.RepoChecksumFile))
+		return nil
+	}
+	if err := writeRepoChecksumFile(opts.RepoChecksumFile, cache.repos.Sums(), cache.repos.Locks()); err != nil {
+		return kerrors.WithMsg(err, fmt.Sprintf("Failed writing repo sum file: %s", opts.RepoChecksumFile))
+	}
+	l.Info(ctx, "Wrote repo sum file", klog.AString("file", opts.RepoChecksumFile))
+	return nil
+}
+
+// reportUnusedRepoChecksums warns of repo checksums and locks that are no
+// longer used by any component
+func reportUnusedRepoChecksums(ctx context.Context, l *klog.LevelLogger, cache *Cache, opts Opts) {
+	unusedSums := cache.repos.UnusedSums()
+	unusedLocks := cache.repos.UnusedLocks()
+	for _, i := range unusedSums {
+		l.Warn(ctx, "Unused repo sum", klog.AString("file", opts.RepoChecksumFile), klog.AString("repo", i.Key))
+	}
+	for _, i := range unusedLocks {
+		l.Warn(ctx, "Unused repo lock", klog.AString("file", opts.RepoChecksumFile), klog.AString("repo", i.Key))
+	}
+	if len(unusedSums) == 0 && len(unusedLocks) == 0 {
+		l.Info(ctx, "Repo sum file is up to date", klog.AString("file", opts.RepoChecksumFile))
+	}
+}
+
+func checkComponents(ctx context.Context, log *klog.LevelLogger, cache *Cache, fsys fs.FS, components []Component, prev []string, opts Opts, failures *failureSet) error {
+	outputs, err := renderOutputs(ctx, log.Logger, cache, components, opts, failures)
+	if err != nil {
+		return err
+	}
+	if failures.len() > 0 {
+		// outputs of failed components are not known to be removed
+		prev = nil
+	}
+	changes, err := DiffOutputs(fsys, outputs, prev)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		log.Info(ctx, "Generated outputs are up to date")
+		return nil
+	}
+	for _, i := range changes {
+		log.Warn(ctx, "Stale output", klog.AString("change", i.Kind), klog.AString("output", i.Path))
+	}
+	return kerrors.WithKind(nil, ErrOutputStale, fmt.Sprintf("Generated outputs are out of date: %d stale", len(changes)))
+}
+
+// Diff reads configs and writes a unified diff of the rendered components
+// against the filesystem
+func Diff(ctx context.Context, log klog.Logger, stdout io.Writer, output, input, cachedir string, opts Opts) error {
+	l := klog.NewLevelLogger(log)
+
+	sums, err := readRepoChecksums(ctx, l, opts)
+	if err != nil {
+		return err
+	}
+	manifest, err := readManifest(ctx, l, opts)
+	if err != nil {
+		return err
+	}
+
+	cache, components, err := parseInput(ctx, log, input, cachedir, sums, opts, nil)
+	if err != nil {
+		return err
+	}
+
+	// outputs are not written, so hooks are listed rather than run
+	opts.DryRun = true
+	outputs, err := renderOutputs(ctx, log, cache, components, opts, nil)
+	if err != nil {
+		return err
+	}
+	changes, err := DiffOutputs(kfs.DirFS(output), outputs, prevOutputs(ctx, l, manifest, output, opts))
+	if err != nil {
+		return err
+	}
+	if err := WriteDiff(stdout, changes); err != nil {
+		return err
+	}
+	l.Info(ctx, "Diffed outputs", klog.AInt("changed", len(changes)))
+	return nil
+}
+
+// Update reads configs, resolves floating repo specs again, and rewrites the
+// repo checksum file with the new locks. Outputs are not written.
+func Update(ctx context.Context, log klog.Logger, input, cachedir string, opts Opts) error {
+	l := klog.NewLevelLogger(log)
+
+	if opts.RepoChecksumFile == "" {
+		return kerrors.WithMsg(nil, "A repo checksum file is required to update repo locks")
+	}
+	if opts.RepoSumStrict {
+		return kerrors.WithMsg(nil, "Repo locks may not be updated in strict repo checksum mode")
+	}
+	sums, err := readRepoChecksums(ctx, l, opts)
+	if err != nil {
+		return err
+	}
+
+	opts.UpdateLocks = true
+	cache, _, err := parseInput(ctx, log, input, cachedir, sums, opts, nil)
+	if err != nil {
+		return err
+	}
+	if err := writeRepoChecksums(ctx, l, cache, opts); err != nil {
+		return err
+	}
+	l.Info(ctx, "Updated repo locks", klog.AInt("locks", len(cache.repos.Locks())))
+	return nil
+}
 
-	if err := WriteComponents(ctx, log, cache, kfs.DirFS(output), components, os.Stderr, opts.DryRun); err != nil {
+// GenerateGraph reads configs and writes the resolved component dependency
+// graph
+func GenerateGraph(ctx context.Context, log klog.Logger, stdout io.Writer, input, cachedir string, format string, opts Opts) error {
+	l := klog.NewLevelLogger(log)
+
+	sums, err := readRepoChecksums(ctx, l, opts)
+	if err != nil {
+		return err
+	}
+
+	local, name := path.Split(input)
+	local = path.Clean(local)
+	name = path.Clean(name)
+
+	args, err := ParseRootArgs(opts.ArgsFiles, opts.Args)
+	if err != nil {
+		return kerrors.WithMsg(err, "Invalid root component args")
+	}
+
+	cache, err := newGenerateCache(ctx, log, local, cachedir, sums, opts)
+	if err != nil {
+		return err
+	}
+
+	g, err := ParseGraph(
+		ctx,
+		cache,
+		repofetcher.Spec{Kind: repoKindLocalDir, RepoSpec: localdir.RepoSpec{}},
+		name,
+		args,
+		os.Stderr,
+		opts.Jobs,
+	)
+	if err != nil {
+		return err
+	}
+	if err := WriteGraph(stdout, g, format); err != nil {
 		return err
 	}
+	l.Info(ctx, "Wrote component graph", klog.AInt("nodes", len(g.Nodes)), klog.AInt("edges", len(g.Edges)))
 	return nil
 }
@@ -1,9 +1,18 @@
 package component
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
 	"context"
+	"encoding/json"
 	"io"
 	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"testing/fstest"
 	"time"
@@ -11,8 +20,12 @@ import (
 	"github.com/stretchr/testify/require"
 	"xorkevin.dev/anvil/confengine"
 	"xorkevin.dev/anvil/confengine/jsonnetengine"
+	"xorkevin.dev/anvil/confengine/starlarkengine"
+	"xorkevin.dev/anvil/confengine/staticfile"
+	"xorkevin.dev/anvil/confengine/yamlengine"
 	"xorkevin.dev/anvil/repofetcher"
 	"xorkevin.dev/anvil/repofetcher/localdir"
+	"xorkevin.dev/kfs"
 	"xorkevin.dev/kfs/kfstest"
 	"xorkevin.dev/klog"
 )
@@ -124,35 +137,1984 @@ local args = anvil.getargs();
 
 			assert := require.New(t)
 
-			cache := NewCache(
-				repofetcher.NewCache(
-					repofetcher.Map{
-						"localdir": localdir.New(tc.LocalFS),
+			for _, jobs := range []int{1, 4} {
+				cache := newTestCache(tc.LocalFS)
+
+				components, err := ParseComponents(context.Background(), cache, repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}, tc.ConfigFile, nil, io.Discard, jobs)
+				assert.NoError(err)
+				assert.Len(components, 2)
+
+				outputfs := &kfstest.MapFS{
+					Fsys: fstest.MapFS{},
+				}
+				assert.NoError(WriteComponents(context.Background(), klog.Discard{}, cache, outputfs, components, io.Discard, jobs, false))
+
+				for k, v := range tc.Files {
+					assert.NotNil(outputfs.Fsys[k])
+					assert.Equal(v, string(outputfs.Fsys[k].Data))
+				}
+			}
+		})
+	}
+}
+
+func TestPruneOutputs(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	var filemode fs.FileMode = 0o644
+
+	for _, tc := range []struct {
+		Name    string
+		Prev    []string
+		Outputs []string
+		DryRun  bool
+		Files   []string
+		Pruned  []string
+	}{
+		{
+			Name:    "prunes stale outputs",
+			Prev:    []string{"anvil_out/foo.txt", "anvil_out/bar/baz.txt", "anvil_out/old.txt"},
+			Outputs: []string{"anvil_out/foo.txt"},
+			Files:   []string{"anvil_out/foo.txt", "anvil_out/other.txt"},
+			Pruned:  []string{"anvil_out/bar/baz.txt", "anvil_out/old.txt"},
+		},
+		{
+			Name:    "dry run",
+			Prev:    []string{"anvil_out/foo.txt", "anvil_out/old.txt"},
+			Outputs: []string{"anvil_out/foo.txt"},
+			DryRun:  true,
+			Files:   []string{"anvil_out/foo.txt", "anvil_out/old.txt", "anvil_out/other.txt"},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			outputfs := &kfstest.MapFS{
+				Fsys: fstest.MapFS{
+					"anvil_out/foo.txt":     &fstest.MapFile{Data: []byte("foo"), Mode: filemode, ModTime: now},
+					"anvil_out/bar/baz.txt": &fstest.MapFile{Data: []byte("baz"), Mode: filemode, ModTime: now},
+					"anvil_out/old.txt":     &fstest.MapFile{Data: []byte("old"), Mode: filemode, ModTime: now},
+					"anvil_out/other.txt":   &fstest.MapFile{Data: []byte("other"), Mode: filemode, ModTime: now},
+				},
+			}
+
+			assert.NoError(PruneOutputs(context.Background(), klog.Discard{}, outputfs, tc.Prev, tc.Outputs, tc.DryRun))
+
+			for _, i := range tc.Files {
+				_, err := fs.Stat(outputfs, i)
+				assert.NoError(err)
+			}
+			for _, i := range tc.Pruned {
+				_, err := fs.Stat(outputfs, i)
+				assert.ErrorIs(err, fs.ErrNotExist)
+			}
+		})
+	}
+}
+
+func TestDiffOutputs(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	now := time.Now()
+	var filemode fs.FileMode = 0o644
+
+	outputfs := &kfstest.MapFS{
+		Fsys: fstest.MapFS{
+			"anvil_out/same.txt":    &fstest.MapFile{Data: []byte("same\n"), Mode: filemode, ModTime: now},
+			"anvil_out/changed.txt": &fstest.MapFile{Data: []byte("old\n"), Mode: filemode, ModTime: now},
+			"anvil_out/stale.txt":   &fstest.MapFile{Data: []byte("stale\n"), Mode: filemode, ModTime: now},
+		},
+	}
+
+	changes, err := DiffOutputs(outputfs, []Output{
+		{Template: Template{Output: "anvil_out/same.txt"}, Data: []byte("same\n")},
+		{Template: Template{Output: "anvil_out/changed.txt"}, Data: []byte("new\n")},
+		{Template: Template{Output: "anvil_out/created.txt"}, Data: []byte("created\n")},
+	}, []string{"anvil_out/same.txt", "anvil_out/stale.txt", "anvil_out/missing.txt"})
+	assert.NoError(err)
+	assert.Equal([]OutputChange{
+		{Kind: OutputChangeUpdate, Path: "anvil_out/changed.txt", Old: []byte("old\n"), New: []byte("new\n")},
+		{Kind: OutputChangeCreate, Path: "anvil_out/created.txt", New: []byte("created\n")},
+		{Kind: OutputChangeDelete, Path: "anvil_out/stale.txt", Old: []byte("stale\n")},
+	}, changes)
+
+	var b strings.Builder
+	assert.NoError(WriteDiff(&b, changes))
+	assert.Equal(`--- a/anvil_out/changed.txt
++++ b/anvil_out/changed.txt
+@@ -1 +1 @@
+-old
++new
+--- /dev/null
++++ b/anvil_out/created.txt
+@@ -0,0 +1 @@
++created
+--- a/anvil_out/stale.txt
++++ /dev/null
+@@ -1 +0,0 @@
+-stale
+`, b.String())
+}
+
+func newTestCache(fsys fs.FS) *Cache {
+	return NewCache(
+		repofetcher.NewCache(
+			repofetcher.Map{
+				"localdir": localdir.New(fsys),
+			},
+			map[string]struct{}{
+				"localdir": {},
+			},
+			nil,
+		),
+		confengine.Map{
+			"jsonnet":    jsonnetengine.Builder{},
+			"jsonnetstr": jsonnetengine.Builder{jsonnetengine.OptStrOut(true)},
+			"staticfile": staticfile.Builder{},
+		},
+		confengine.Map{
+			configKindJsonnet:  jsonnetengine.Builder{},
+			configKindYAML:     yamlengine.Builder{},
+			configKindJSON:     yamlengine.Builder{},
+			configKindStarlark: starlarkengine.Builder{},
+		},
+	)
+}
+
+func TestCheckComponents(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	var filemode fs.FileMode = 0o644
+
+	localfs := &kfstest.MapFS{
+		Fsys: fstest.MapFS{
+			"config.jsonnet": &fstest.MapFile{
+				Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha1',
+  templates: [
+    { kind: 'staticfile', path: 'foo.txt', output: 'foo.txt' },
+  ],
+}
+`),
+				Mode:    filemode,
+				ModTime: now,
+			},
+			"foo.txt": &fstest.MapFile{
+				Data:    []byte("foo\n"),
+				Mode:    filemode,
+				ModTime: now,
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		Name   string
+		Output fstest.MapFS
+		Prev   []string
+		Stale  bool
+	}{
+		{
+			Name: "clean",
+			Output: fstest.MapFS{
+				"foo.txt": &fstest.MapFile{Data: []byte("foo\n"), Mode: filemode, ModTime: now},
+			},
+			Prev: []string{"foo.txt", "pruned.txt"},
+		},
+		{
+			Name: "stale",
+			Output: fstest.MapFS{
+				"foo.txt": &fstest.MapFile{Data: []byte("old foo\n"), Mode: filemode, ModTime: now},
+			},
+			Stale: true,
+		},
+		{
+			Name:   "missing",
+			Output: fstest.MapFS{},
+			Stale:  true,
+		},
+		{
+			Name: "unpruned",
+			Output: fstest.MapFS{
+				"foo.txt":    &fstest.MapFile{Data: []byte("foo\n"), Mode: filemode, ModTime: now},
+				"pruned.txt": &fstest.MapFile{Data: []byte("pruned\n"), Mode: filemode, ModTime: now},
+			},
+			Prev:  []string{"foo.txt", "pruned.txt"},
+			Stale: true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			cache := newTestCache(localfs)
+			components, err := ParseComponents(context.Background(), cache, repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}, "config.jsonnet", nil, io.Discard, 1)
+			assert.NoError(err)
+
+			outputfs := &kfstest.MapFS{
+				Fsys: maps.Clone(tc.Output),
+			}
+			err = checkComponents(context.Background(), klog.NewLevelLogger(klog.Discard{}), cache, outputfs, components, tc.Prev, Opts{}, nil)
+			if tc.Stale {
+				assert.ErrorIs(err, ErrOutputStale)
+			} else {
+				assert.NoError(err)
+			}
+			// check mode never writes outputs
+			assert.Equal(tc.Output, outputfs.Fsys)
+		})
+	}
+}
+
+func TestWriteOutputs(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	now := time.Now()
+	var filemode fs.FileMode = 0o644
+
+	cache := newTestCache(&kfstest.MapFS{
+		Fsys: fstest.MapFS{
+			"components/config.jsonnet": &fstest.MapFile{
+				Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha2',
+  templates: [
+    {
+      kind: 'staticfile',
+      path: 'run.sh',
+      output: 'anvil_out/run.sh',
+      output_mode: '0755',
+    },
+    {
+      output: 'anvil_out/link',
+      output_kind: 'symlink',
+      link_target: 'run.sh',
+    },
+    {
+      output: 'anvil_out/empty',
+      output_kind: 'dir',
+    },
+  ],
+  components: [],
+}
+`),
+				Mode:    filemode,
+				ModTime: now,
+			},
+			"components/run.sh": &fstest.MapFile{
+				Data:    []byte("#!/bin/sh\n"),
+				Mode:    filemode,
+				ModTime: now,
+			},
+		},
+	})
+
+	outputfs := &kfstest.MapFS{
+		Fsys: fstest.MapFS{
+			"anvil_out/run.sh": &fstest.MapFile{Data: []byte("#!/bin/sh\n"), Mode: filemode, ModTime: now},
+		},
+	}
+
+	components, err := ParseComponents(context.Background(), cache, repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}, "components/config.jsonnet", nil, io.Discard, 1)
+	assert.NoError(err)
+	outputs, err := RenderComponents(context.Background(), klog.Discard{}, cache, components, io.Discard, 1)
+	assert.NoError(err)
+
+	changes, err := DiffOutputs(outputfs, outputs, nil)
+	assert.NoError(err)
+	assert.Equal([]OutputChange{
+		{Kind: OutputChangeCreate, Path: "anvil_out/empty", New: []byte("directory\n")},
+		{Kind: OutputChangeCreate, Path: "anvil_out/link", New: []byte("symlink run.sh\n")},
+		{Kind: OutputChangeUpdate, Path: "anvil_out/run.sh", Old: []byte("#!/bin/sh\n"), New: []byte("#!/bin/sh\n"), OldMode: 0o644, NewMode: 0o755},
+	}, changes)
+
+	assert.NoError(WriteOutputs(context.Background(), klog.Discard{}, outputfs, outputs, false))
+
+	assert.Equal(fs.FileMode(0o755), outputfs.Fsys["anvil_out/run.sh"].Mode)
+	target, err := kfs.ReadLink(outputfs, "anvil_out/link")
+	assert.NoError(err)
+	assert.Equal("run.sh", target)
+	info, err := fs.Stat(outputfs, "anvil_out/empty")
+	assert.NoError(err)
+	assert.True(info.IsDir())
+
+	changes, err = DiffOutputs(outputfs, outputs, nil)
+	assert.NoError(err)
+	assert.Equal([]OutputChange(nil), changes)
+
+	for _, i := range []Template{
+		{Output: "anvil_out/foo", OutputKind: "socket"},
+		{Output: "anvil_out/foo", OutputKind: OutputKindDir, OutputMode: "01755"},
+		{Output: "anvil_out/foo", OutputKind: OutputKindSymlink},
+		{Output: "anvil_out/foo", OutputKind: OutputKindSymlink, LinkTarget: "/etc"},
+		{Output: "anvil_out/foo", OutputKind: OutputKindSymlink, LinkTarget: "../../etc"},
+		{Output: "foo", OutputKind: OutputKindSymlink, LinkTarget: "bar/../.."},
+	} {
+		_, err := renderOutput(context.Background(), cache, Component{}, i, io.Discard)
+		assert.ErrorIs(err, ErrInvalidOutput)
+	}
+	_, err = renderOutput(context.Background(), cache, Component{}, Template{Output: "anvil_out/foo", OutputKind: OutputKindSymlink, LinkTarget: "../run.sh"}, io.Discard)
+	assert.NoError(err)
+
+	assert.ErrorIs(WriteOutputs(context.Background(), klog.Discard{}, outputfs, []Output{
+		{Spec: repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}, Template: Template{Output: "anvil_out/escape"}, Kind: OutputKindSymlink, Data: []byte("../../etc")},
+	}, false), ErrInvalidOutput)
+}
+
+func TestOutputCollisionsSymlinkParent(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	local := repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}
+	assert.ErrorIs(checkOutputCollisions([]Component{
+		{Spec: local, Dir: "a", Templates: []Template{
+			{Output: "anvil_out/link", OutputKind: OutputKindSymlink, LinkTarget: "real"},
+		}},
+		{Spec: local, Dir: "b", Templates: []Template{
+			{Kind: "staticfile", Path: "foo.txt", Output: "anvil_out/link/sub/foo.txt"},
+		}},
+	}), ErrOutputCollision)
+	assert.NoError(checkOutputCollisions([]Component{
+		{Spec: local, Dir: "a", Templates: []Template{
+			{Output: "anvil_out/link", OutputKind: OutputKindSymlink, LinkTarget: "real"},
+			{Kind: "staticfile", Path: "foo.txt", Output: "anvil_out/real/foo.txt"},
+		}},
+	}))
+}
+
+func TestOutputCollisions(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	var filemode fs.FileMode = 0o644
+
+	for _, tc := range []struct {
+		Name      string
+		Overwrite bool
+		Err       error
+	}{
+		{
+			Name:      "collision",
+			Overwrite: false,
+			Err:       ErrOutputCollision,
+		},
+		{
+			Name:      "explicit overwrite",
+			Overwrite: true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			overwrite := "false"
+			if tc.Overwrite {
+				overwrite = "true"
+			}
+
+			cache := newTestCache(&kfstest.MapFS{
+				Fsys: fstest.MapFS{
+					"components/config.jsonnet": &fstest.MapFile{
+						Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha2',
+  templates: [
+    {
+      kind: 'staticfile',
+      path: 'foo.txt',
+      output: 'anvil_out/foo.txt',
+      overwrite: ` + overwrite + `,
+    },
+  ],
+  components: [
+    {
+      path: 'subcomp/config.jsonnet',
+    },
+  ],
+}
+`),
+						Mode:    filemode,
+						ModTime: now,
+					},
+					"components/subcomp/config.jsonnet": &fstest.MapFile{
+						Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha1',
+  templates: [
+    {
+      kind: 'staticfile',
+      path: 'bar.txt',
+      output: 'anvil_out/foo.txt',
+    },
+  ],
+  components: [],
+}
+`),
+						Mode:    filemode,
+						ModTime: now,
+					},
+				},
+			})
+
+			_, err := ParseComponents(context.Background(), cache, repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}, "components/config.jsonnet", nil, io.Discard, 1)
+			if tc.Err != nil {
+				assert.ErrorIs(err, tc.Err)
+				assert.ErrorContains(err, "Output anvil_out/foo.txt of template foo.txt in localdir:localdir components collides with template bar.txt in localdir:localdir components/subcomp")
+			} else {
+				assert.NoError(err)
+			}
+		})
+	}
+}
+
+func TestWriteOutputsStaged(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	parent := t.TempDir()
+	output := filepath.Join(parent, "out")
+	assert.NoError(os.Mkdir(output, 0o777))
+	for k, v := range map[string]string{
+		"keep.txt":  "keep\n",
+		"foo.txt":   "old foo\n",
+		"stale.txt": "stale\n",
+		"blocker":   "not a dir\n",
+	} {
+		assert.NoError(os.WriteFile(filepath.Join(output, k), []byte(v), 0o644))
+	}
+
+	readOutputs := func() map[string]string {
+		res := map[string]string{}
+		assert.NoError(fs.WalkDir(os.DirFS(output), ".", func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			b, err := os.ReadFile(filepath.Join(output, filepath.FromSlash(p)))
+			if err != nil {
+				return err
+			}
+			res[p] = string(b)
+			return nil
+		}))
+		return res
+	}
+	original := readOutputs()
+
+	fileOutput := func(name, data string) Output {
+		return Output{
+			Spec:     repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}},
+			Template: Template{Output: name},
+			Kind:     OutputKindFile,
+			Mode:     defaultFileMode,
+			Data:     []byte(data),
+		}
+	}
+
+	// the output under an existing file fails to commit after other outputs
+	// have already been moved into place
+	err := writeOutputsStaged(context.Background(), klog.NewLevelLogger(klog.Discard{}), output, []Output{
+		fileOutput("foo.txt", "new foo\n"),
+		fileOutput("bar/bar.txt", "bar\n"),
+		fileOutput("blocker/baz.txt", "baz\n"),
+	}, []string{"stale.txt"})
+	assert.Error(err)
+	assert.Equal(original, readOutputs())
+	entries, err := os.ReadDir(output)
+	assert.NoError(err)
+	assert.Len(entries, len(original))
+	// the staging dir is created next to the output dir and removed
+	entries, err = os.ReadDir(parent)
+	assert.NoError(err)
+	assert.Len(entries, 1)
+
+	assert.NoError(writeOutputsStaged(context.Background(), klog.NewLevelLogger(klog.Discard{}), output, []Output{
+		fileOutput("foo.txt", "new foo\n"),
+		fileOutput("bar/bar.txt", "bar\n"),
+	}, []string{"stale.txt"}))
+	assert.Equal(map[string]string{
+		"keep.txt":    "keep\n",
+		"foo.txt":     "new foo\n",
+		"bar/bar.txt": "bar\n",
+		"blocker":     "not a dir\n",
+	}, readOutputs())
+
+	// unchanged outputs are not rewritten
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.NoError(os.Chtimes(filepath.Join(output, "foo.txt"), past, past))
+	assert.NoError(writeOutputsStaged(context.Background(), klog.NewLevelLogger(klog.Discard{}), output, []Output{
+		fileOutput("foo.txt", "new foo\n"),
+		fileOutput("bar/bar.txt", "updated bar\n"),
+	}, nil))
+	info, err := os.Stat(filepath.Join(output, "foo.txt"))
+	assert.NoError(err)
+	assert.True(past.Equal(info.ModTime()))
+	assert.Equal("updated bar\n", readOutputs()["bar/bar.txt"])
+}
+
+func TestComponentParams(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	var filemode fs.FileMode = 0o644
+
+	for _, tc := range []struct {
+		Name   string
+		Args   string
+		Output string
+		Err    string
+	}{
+		{
+			Name:   "applies defaults",
+			Args:   `{name: 'foo'}`,
+			Output: "anvil_out/foo-8080",
+		},
+		{
+			Name:   "overrides defaults",
+			Args:   `{name: 'foo', port: 3000}`,
+			Output: "anvil_out/foo-3000",
+		},
+		{
+			Name: "missing required arg",
+			Args: `{port: 3000}`,
+			Err:  "Missing required arg name",
+		},
+		{
+			Name: "unknown arg",
+			Args: `{nmae: 'foo'}`,
+			Err:  "Unknown args: nmae",
+		},
+		{
+			Name: "invalid arg type",
+			Args: `{name: 'foo', port: '3000'}`,
+			Err:  "Arg port is not of type number",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			cache := newTestCache(&kfstest.MapFS{
+				Fsys: fstest.MapFS{
+					"components/config.jsonnet": &fstest.MapFile{
+						Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha1',
+  templates: [],
+  components: [
+    {
+      path: 'subcomp/config.jsonnet',
+      args: ` + tc.Args + `,
+    },
+  ],
+}
+`),
+						Mode:    filemode,
+						ModTime: now,
+					},
+					"components/subcomp/config.jsonnet": &fstest.MapFile{
+						Data: []byte(`
+local anvil = import 'anvil:std';
+local args = anvil.getargs();
+
+{
+  version: 'xorkevin.dev/anvil/v1alpha2',
+  params: {
+    name: {
+      type: 'string',
+      required: true,
+      description: 'Name of the service',
+    },
+    port: {
+      type: 'number',
+      default: 8080,
+    },
+  },
+  templates: [
+    {
+      kind: 'staticfile',
+      path: 'foo.txt',
+      output: 'anvil_out/%s-%d' % [args.name, args.port],
+    },
+  ],
+  components: [],
+}
+`),
+						Mode:    filemode,
+						ModTime: now,
+					},
+				},
+			})
+
+			components, err := ParseComponents(context.Background(), cache, repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}, "components/config.jsonnet", nil, io.Discard, 1)
+			if tc.Err != "" {
+				assert.ErrorIs(err, ErrInvalidArgs)
+				assert.ErrorContains(err, tc.Err)
+				assert.ErrorContains(err, "Invalid args passed by component config localdir:localdir components/config.jsonnet to component config localdir:localdir components/subcomp/config.jsonnet")
+				return
+			}
+			assert.NoError(err)
+			assert.Len(components, 2)
+			assert.Equal(tc.Output, components[0].Templates[0].Output)
+		})
+	}
+}
+
+func TestComponentEvaluations(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	now := time.Now()
+	var filemode fs.FileMode = 0o644
+
+	cache := newTestCache(&kfstest.MapFS{
+		Fsys: fstest.MapFS{
+			"components/config.jsonnet": &fstest.MapFile{
+				Data: []byte(`
+std.trace('eval root', {
+  version: 'xorkevin.dev/anvil/v1alpha2',
+  templates: [],
+  components: [
+    { path: 'sub/config.jsonnet', args: { mode: 'prod' } },
+  ],
+})
+`),
+				Mode:    filemode,
+				ModTime: now,
+			},
+			"components/sub/config.jsonnet": &fstest.MapFile{
+				Data: []byte(`
+local anvil = import 'anvil:std';
+local args = anvil.getargs();
+
+std.trace('eval sub', {
+  version: 'xorkevin.dev/anvil/v1alpha2',
+  // params may depend on the args as imported
+  params: if args.mode == 'prod' then {
+    mode: { type: 'string' },
+    replicas: { type: 'number', default: 3 },
+  } else {},
+  templates: [
+    {
+      kind: 'staticfile',
+      path: 'foo.txt',
+      output: 'anvil_out/%s-%d' % [args.mode, args.replicas],
+    },
+  ],
+})
+`),
+				Mode:    filemode,
+				ModTime: now,
+			},
+		},
+	})
+
+	var stderr bytes.Buffer
+	components, err := ParseComponents(context.Background(), cache, repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}, "components/config.jsonnet", nil, &stderr, 1)
+	assert.NoError(err)
+	assert.Len(components, 2)
+	assert.Equal("anvil_out/prod-3", components[0].Templates[0].Output)
+	// configs without named subcomponents are evaluated for their params and
+	// then once in full
+	assert.Equal(2, strings.Count(stderr.String(), "eval root"))
+	assert.Equal(2, strings.Count(stderr.String(), "eval sub"))
+}
+
+func TestComponentExports(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	var filemode fs.FileMode = 0o644
+
+	for _, tc := range []struct {
+		Name    string
+		SubName string
+		Output  string
+		Err     error
+	}{
+		{
+			Name:    "reads subcomponent exports",
+			SubName: "bar",
+			Output:  "anvil_out/svc-foo-svc-bar.txt",
+		},
+		{
+			Name:    "duplicate names",
+			SubName: "foo",
+			Err:     ErrInvalidExports,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			cache := newTestCache(&kfstest.MapFS{
+				Fsys: fstest.MapFS{
+					"components/config.jsonnet": &fstest.MapFile{
+						Data: []byte(`
+local anvil = import 'anvil:std';
+local exports = anvil.getexports();
+
+{
+  version: 'xorkevin.dev/anvil/v1alpha2',
+  templates: [
+    {
+      kind: 'staticfile',
+      path: 'foo.txt',
+      output: 'anvil_out/%s-%s.txt' % [exports.foo.service, exports['` + tc.SubName + `'].service],
+    },
+  ],
+  components: [
+    {
+      name: 'foo',
+      path: 'subcomp/config.jsonnet',
+      args: {
+        name: 'foo',
+      },
+    },
+    {
+      name: '` + tc.SubName + `',
+      path: 'subcomp/config.jsonnet',
+      args: {
+        name: 'bar',
+      },
+    },
+  ],
+}
+`),
+						Mode:    filemode,
+						ModTime: now,
+					},
+					"components/subcomp/config.jsonnet": &fstest.MapFile{
+						Data: []byte(`
+local anvil = import 'anvil:std';
+local args = anvil.getargs();
+
+{
+  version: 'xorkevin.dev/anvil/v1alpha2',
+  templates: [],
+  components: [],
+  exports: {
+    service: 'svc-%s' % [args.name],
+  },
+}
+`),
+						Mode:    filemode,
+						ModTime: now,
+					},
+				},
+			})
+
+			components, err := ParseComponents(context.Background(), cache, repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}, "components/config.jsonnet", nil, io.Discard, 2)
+			if tc.Err != nil {
+				assert.ErrorIs(err, tc.Err)
+				return
+			}
+			assert.NoError(err)
+			assert.Len(components, 3)
+			assert.Equal(tc.Output, components[2].Templates[0].Output)
+		})
+	}
+}
+
+func TestParseGraph(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	now := time.Now()
+	var filemode fs.FileMode = 0o644
+
+	cache := newTestCache(&kfstest.MapFS{
+		Fsys: fstest.MapFS{
+			"components/config.jsonnet": &fstest.MapFile{
+				Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha1',
+  templates: [],
+  components: [
+    {
+      path: 'subcomp/config.jsonnet',
+      args: {
+        name: 'foo',
+      },
+    },
+    {
+      path: 'subcomp/config.jsonnet',
+      args: {
+        name: 'bar',
+      },
+    },
+  ],
+}
+`),
+				Mode:    filemode,
+				ModTime: now,
+			},
+			"components/subcomp/config.jsonnet": &fstest.MapFile{
+				Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha1',
+  templates: [],
+  components: [],
+}
+`),
+				Mode:    filemode,
+				ModTime: now,
+			},
+		},
+	})
+
+	g, err := ParseGraph(context.Background(), cache, repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}, "components/config.jsonnet", nil, io.Discard, 1)
+	assert.NoError(err)
+
+	rootHash, err := argsHash(nil)
+	assert.NoError(err)
+	fooHash, err := argsHash(map[string]any{"name": "foo"})
+	assert.NoError(err)
+	barHash, err := argsHash(map[string]any{"name": "bar"})
+	assert.NoError(err)
+	root := "localdir:localdir:components/config.jsonnet#" + rootHash
+
+	assert.Len(g.Nodes, 3)
+	assert.Contains(g.Nodes, GraphNode{
+		ID:       root,
+		Repo:     "localdir:localdir",
+		Dir:      "components",
+		Name:     "config.jsonnet",
+		ArgsHash: rootHash,
+	})
+	assert.ElementsMatch([]GraphEdge{
+		{From: root, To: "localdir:localdir:components/subcomp/config.jsonnet#" + fooHash},
+		{From: root, To: "localdir:localdir:components/subcomp/config.jsonnet#" + barHash},
+	}, g.Edges)
+
+	var b strings.Builder
+	assert.NoError(WriteGraph(&b, g, GraphFormatDot))
+	assert.Contains(b.String(), `"`+root+`" -> "localdir:localdir:components/subcomp/config.jsonnet#`+fooHash+`";`)
+	assert.ErrorIs(WriteGraph(&b, g, "svg"), ErrUnknownGraphFormat)
+}
+
+func TestDotQuote(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Name     string
+		Lines    []string
+		Expected string
+	}{
+		{
+			Name:     "escapes quotes and backslashes",
+			Lines:    []string{`a "b" \c`},
+			Expected: `"a \"b\" \\c"`,
+		},
+		{
+			Name:     "keeps non ascii characters",
+			Lines:    []string{"résumé/日本"},
+			Expected: `"résumé/日本"`,
+		},
+		{
+			Name:     "separates lines with line breaks",
+			Lines:    []string{"repo", "dir/config.jsonnet"},
+			Expected: `"repo\ndir/config.jsonnet"`,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			assert.Equal(tc.Expected, dotLabel(tc.Lines...))
+			if len(tc.Lines) == 1 {
+				assert.Equal(tc.Expected, dotQuote(tc.Lines[0]))
+			}
+		})
+	}
+}
+
+func TestDiamondImports(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	var filemode fs.FileMode = 0o644
+
+	for _, tc := range []struct {
+		Name  string
+		BArgs string
+		Err   error
+	}{
+		{
+			Name:  "identical imports are merged",
+			BArgs: `{name: 'foo'}`,
+		},
+		{
+			Name:  "conflicting imports",
+			BArgs: `{name: 'bar'}`,
+			Err:   ErrImportConflict,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			cache := newTestCache(&kfstest.MapFS{
+				Fsys: fstest.MapFS{
+					"components/config.jsonnet": &fstest.MapFile{
+						Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha1',
+  templates: [],
+  components: [
+    {
+      path: 'a/config.jsonnet',
+    },
+    {
+      path: 'b/config.jsonnet',
+    },
+  ],
+}
+`),
+						Mode:    filemode,
+						ModTime: now,
+					},
+					"components/a/config.jsonnet": &fstest.MapFile{
+						Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha1',
+  templates: [],
+  components: [
+    {
+      path: '../shared/config.jsonnet',
+      args: {name: 'foo'},
+    },
+  ],
+}
+`),
+						Mode:    filemode,
+						ModTime: now,
+					},
+					"components/b/config.jsonnet": &fstest.MapFile{
+						Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha1',
+  templates: [],
+  components: [
+    {
+      path: '../shared/config.jsonnet',
+      args: ` + tc.BArgs + `,
+    },
+  ],
+}
+`),
+						Mode:    filemode,
+						ModTime: now,
+					},
+					"components/shared/config.jsonnet": &fstest.MapFile{
+						Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha1',
+  templates: [
+    {
+      kind: 'staticfile',
+      path: 'foo.txt',
+      output: 'anvil_out/shared.txt',
+    },
+  ],
+  components: [],
+}
+`),
+						Mode:    filemode,
+						ModTime: now,
+					},
+				},
+			})
+
+			components, err := ParseComponents(context.Background(), cache, repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}, "components/config.jsonnet", nil, io.Discard, 1)
+			if tc.Err != nil {
+				assert.ErrorIs(err, tc.Err)
+				assert.ErrorContains(err, "localdir:localdir:components/config.jsonnet -> localdir:localdir:components/a/config.jsonnet -> localdir:localdir:components/shared/config.jsonnet")
+				assert.ErrorContains(err, "localdir:localdir:components/config.jsonnet -> localdir:localdir:components/b/config.jsonnet -> localdir:localdir:components/shared/config.jsonnet")
+				return
+			}
+			assert.NoError(err)
+			dirs := make([]string, 0, len(components))
+			for _, i := range components {
+				dirs = append(dirs, i.Dir)
+			}
+			assert.Equal([]string{"components/shared", "components/a", "components/b", "components"}, dirs)
+		})
+	}
+}
+
+func TestImportCycles(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	var filemode fs.FileMode = 0o644
+
+	for _, tc := range []struct {
+		Name string
+		Jobs int
+	}{
+		{
+			Name: "sequential",
+			Jobs: 1,
+		},
+		{
+			Name: "concurrent",
+			Jobs: 4,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			cache := newTestCache(&kfstest.MapFS{
+				Fsys: fstest.MapFS{
+					"components/config.jsonnet": &fstest.MapFile{
+						Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha1',
+  templates: [],
+  components: [
+    {
+      path: 'a/config.jsonnet',
+    },
+    {
+      path: 'b/config.jsonnet',
+    },
+  ],
+}
+`),
+						Mode:    filemode,
+						ModTime: now,
 					},
-					map[string]struct{}{
-						"localdir": {},
+					"components/a/config.jsonnet": &fstest.MapFile{
+						Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha1',
+  templates: [],
+  components: [
+    {
+      path: '../b/config.jsonnet',
+    },
+  ],
+}
+`),
+						Mode:    filemode,
+						ModTime: now,
+					},
+					"components/b/config.jsonnet": &fstest.MapFile{
+						Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha1',
+  templates: [],
+  components: [
+    {
+      path: '../a/config.jsonnet',
+    },
+  ],
+}
+`),
+						Mode:    filemode,
+						ModTime: now,
 					},
-					nil,
-				),
-				confengine.Map{
-					configKindJsonnet: jsonnetengine.Builder{},
-					"jsonnetstr":      jsonnetengine.Builder{jsonnetengine.OptStrOut(true)},
 				},
-			)
+			})
+
+			_, err := ParseComponents(context.Background(), cache, repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}, "components/config.jsonnet", nil, io.Discard, tc.Jobs)
+			assert.ErrorIs(err, ErrImportCycle)
+		})
+	}
+}
+
+func TestMigrateConfig(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Name     string
+		Config   configData
+		Expected configData
+		Err      error
+		Msg      string
+	}{
+		{
+			Name: "migrates v1alpha1",
+			Config: configData{
+				Version:    ConfigVersionV1Alpha1,
+				Templates:  []Template{{Output: "foo"}, {Output: "bar"}},
+				Components: []componentData{{Path: "sub/config.yaml"}},
+			},
+			Expected: configData{
+				Version:    ConfigVersionLatest,
+				Templates:  []Template{{Output: "foo", OutputKind: OutputKindFile}, {Output: "bar", OutputKind: OutputKindFile}},
+				Components: []componentData{{Path: "sub/config.yaml", ConfigKind: configKindJsonnet}},
+			},
+		},
+		{
+			Name: "migrates missing version as v1alpha1",
+			Config: configData{
+				Templates: []Template{{Output: "foo"}},
+			},
+			Expected: configData{
+				Version:   ConfigVersionLatest,
+				Templates: []Template{{Output: "foo", OutputKind: OutputKindFile}},
+			},
+		},
+		{
+			Name: "rejects v1alpha2 fields in v1alpha1",
+			Config: configData{
+				Version:   ConfigVersionV1Alpha1,
+				Hooks:     []Hook{{}},
+				Templates: []Template{{Output: "foo", OutputMode: "0755"}},
+			},
+			Err: ErrUnsupportedVersion,
+			Msg: "hooks, templates[0].output_mode",
+		},
+		{
+			Name: "leaves latest unchanged",
+			Config: configData{
+				Version:   ConfigVersionLatest,
+				Templates: []Template{{Output: "foo"}},
+			},
+			Expected: configData{
+				Version:   ConfigVersionLatest,
+				Templates: []Template{{Output: "foo"}},
+			},
+		},
+		{
+			Name:   "rejects unknown version",
+			Config: configData{Version: "xorkevin.dev/anvil/v9"},
+			Err:    ErrUnsupportedVersion,
+			Msg:    ConfigVersionV1Alpha1,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
 
-			components, err := ParseComponents(context.Background(), cache, repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}, tc.ConfigFile, io.Discard)
+			assert := require.New(t)
+
+			config := tc.Config
+			err := migrateConfig(&config)
+			if tc.Err != nil {
+				assert.ErrorIs(err, tc.Err)
+				assert.ErrorContains(err, tc.Msg)
+				return
+			}
 			assert.NoError(err)
-			assert.Len(components, 2)
+			assert.Equal(tc.Expected, config)
+		})
+	}
+}
 
-			outputfs := &kfstest.MapFS{
-				Fsys: fstest.MapFS{},
+func TestParseRootArgs(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	jsonFile := filepath.Join(dir, "args.json")
+	yamlFile := filepath.Join(dir, "args.yaml")
+	assert.NoError(os.WriteFile(jsonFile, []byte(`{"name": "foo", "replicas": 1, "db": {"host": "localhost", "port": 5432}}`), 0o644))
+	assert.NoError(os.WriteFile(yamlFile, []byte("replicas: 3\ndb:\n  host: db.example.com\n"), 0o644))
+
+	args, err := ParseRootArgs([]string{filepath.ToSlash(jsonFile), filepath.ToSlash(yamlFile)}, []string{
+		"db.port=5433",
+		"debug=true",
+		"tags=[\"a\",\"b\"]",
+		"svc.name=bar",
+	})
+	assert.NoError(err)
+	assert.Equal(map[string]any{
+		"name":     "foo",
+		"replicas": float64(3),
+		"db": map[string]any{
+			"host": "db.example.com",
+			"port": float64(5433),
+		},
+		"debug": true,
+		"tags":  []any{"a", "b"},
+		"svc": map[string]any{
+			"name": "bar",
+		},
+	}, args)
+
+	_, err = ParseRootArgs(nil, []string{"name.first=foo", "name.first.initial=f"})
+	assert.ErrorIs(err, ErrInvalidArgs)
+	_, err = ParseRootArgs(nil, []string{"name"})
+	assert.ErrorIs(err, ErrInvalidArgs)
+
+	args, err = ParseRootArgs(nil, nil)
+	assert.NoError(err)
+	assert.Nil(args)
+
+	args, err = MergeRootArgs(
+		RootArgs{
+			Files: []string{filepath.ToSlash(yamlFile)},
+			Args:  map[string]any{"replicas": 2, "name": "foo"},
+		},
+		RootArgs{
+			Sets: []string{"name=bar"},
+		},
+	)
+	assert.NoError(err)
+	assert.Equal(map[string]any{
+		"name":     "bar",
+		"replicas": float64(2),
+		"db": map[string]any{
+			"host": "db.example.com",
+		},
+	}, args)
+}
+
+func TestWatchAffectedComponents(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	local := repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}
+	w := &watcher{
+		local: "comp",
+		components: []Component{
+			{Spec: local, Dir: "sub", Templates: []Template{
+				{Kind: "staticfile", Path: "a.txt", Output: "a.txt"},
+				{Kind: "staticfile", Path: "b.txt", Output: "b.txt"},
+			}},
+			{Spec: local, Dir: ".", Templates: []Template{
+				{Kind: "staticfile", Path: "c.txt", Output: "b.txt", Overwrite: true},
+			}},
+		},
+	}
+
+	affected, ok := w.affectedComponents([]string{filepath.Join("comp", "sub", "a.txt")})
+	assert.True(ok)
+	assert.Equal([]Component{
+		{Spec: local, Dir: "sub", Templates: []Template{{Kind: "staticfile", Path: "a.txt", Output: "a.txt"}}},
+	}, affected)
+
+	// overwritten outputs are not rerendered
+	affected, ok = w.affectedComponents([]string{filepath.Join("comp", "sub", "b.txt")})
+	assert.True(ok)
+	assert.Len(affected, 0)
+
+	_, ok = w.affectedComponents([]string{filepath.Join("comp", "sub", "config.jsonnet")})
+	assert.False(ok)
+}
+
+func TestWatchDirs(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	for _, i := range []string{"comp/sub/nested", "comp/.git/objects", "comp/out/a", "lib/x"} {
+		assert.NoError(os.MkdirAll(filepath.Join(dir, filepath.FromSlash(i)), 0o777))
+	}
+	local := repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}
+	w := &watcher{
+		log:         klog.NewLevelLogger(klog.Discard{}),
+		local:       filepath.ToSlash(filepath.Join(dir, "comp")),
+		ignoreDirs:  []string{filepath.Join(dir, "comp", "out")},
+		replaceDirs: []string{filepath.Join(dir, "lib")},
+		components: []Component{
+			{Spec: local, Dir: "."},
+		},
+	}
+
+	dirs := w.watchDirs(context.Background())
+	var names []string
+	for k := range dirs {
+		rel, err := filepath.Rel(dir, k)
+		assert.NoError(err)
+		names = append(names, filepath.ToSlash(rel))
+	}
+	slices.Sort(names)
+	// nested dirs are watched, while hidden and output dirs are not
+	assert.Equal([]string{"comp", "comp/sub", "comp/sub/nested", "lib", "lib/x"}, names)
+}
+
+func TestMatchGlob(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Pattern string
+		Name    string
+		Match   bool
+	}{
+		{Pattern: "*.go", Name: "a.go", Match: true},
+		{Pattern: "*.go", Name: "sub/a.go", Match: false},
+		{Pattern: "**/*.go", Name: "a.go", Match: true},
+		{Pattern: "**/*.go", Name: "sub/dir/a.go", Match: true},
+		{Pattern: "sub/**", Name: "sub/dir/a.go", Match: true},
+		{Pattern: "sub/**", Name: "other/a.go", Match: false},
+		{Pattern: "sub/**/a.go", Name: "sub/a.go", Match: true},
+		{Pattern: "sub/**/a.go", Name: "sub/dir/b.go", Match: false},
+	} {
+		t.Run(tc.Pattern+" "+tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			ok, err := matchGlob(tc.Pattern, tc.Name)
+			assert.NoError(err)
+			assert.Equal(tc.Match, ok)
+		})
+	}
+}
+
+func TestApplyHooks(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	hook := Hook{
+		Cmd:     "sh",
+		Args:    []string{"-c", `for f; do echo formatted > "$f"; done`, "fmt"},
+		Outputs: []string{"**/*.go"},
+	}
+	local := repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}
+	remote := repofetcher.Spec{Kind: "mock", RepoSpec: localdir.RepoSpec{}}
+	components := func(spec repofetcher.Spec, hooks ...Hook) []Component {
+		return []Component{
+			{Spec: spec, Dir: "a", Hooks: hooks, Templates: []Template{
+				{Output: "a.go"},
+				{Output: "sub/b.go"},
+				{Output: "c.yaml"},
+			}},
+			{Spec: spec, Dir: "b", Templates: []Template{
+				{Output: "d.go"},
+			}},
+		}
+	}
+	outputs := func() []Output {
+		var res []Output
+		for _, i := range components(local) {
+			for _, j := range i.Templates {
+				res = append(res, Output{Spec: i.Spec, Dir: i.Dir, Template: j, Kind: OutputKindFile, Data: []byte("unformatted\n")})
+			}
+		}
+		return res
+	}
+	data := func(outputs []Output) []string {
+		var res []string
+		for _, i := range outputs {
+			res = append(res, string(i.Data))
+		}
+		return res
+	}
+	log := klog.NewLevelLogger(klog.Discard{})
+	unformatted := []string{"unformatted\n", "unformatted\n", "unformatted\n", "unformatted\n"}
+
+	o := outputs()
+	assert.NoError(applyHooks(context.Background(), log, components(local, hook), o, Opts{NoHooks: true}))
+	assert.Equal(unformatted, data(o))
+
+	// hooks are listed rather than run in dry run and check mode
+	for _, i := range []Opts{{DryRun: true}, {Check: true}} {
+		o = outputs()
+		assert.NoError(applyHooks(context.Background(), log, components(local, hook), o, i))
+		assert.Equal(unformatted, data(o))
+		assert.True(o[0].HookSkipped)
+		assert.True(o[1].HookSkipped)
+		assert.False(o[2].HookSkipped)
+		assert.True(o[3].HookSkipped)
+	}
+
+	o = outputs()
+	for n := range o {
+		o[n].Spec = remote
+	}
+	assert.NoError(applyHooks(context.Background(), log, components(remote, hook), o, Opts{}))
+	assert.Equal(unformatted, data(o))
+
+	// hooks of local components match every output
+	o = outputs()
+	assert.NoError(applyHooks(context.Background(), log, components(local, hook), o, Opts{}))
+	assert.Equal([]string{"formatted\n", "formatted\n", "unformatted\n", "formatted\n"}, data(o))
+
+	// hooks of remote components only match outputs of their own component
+	o = outputs()
+	for n := range o {
+		o[n].Spec = remote
+	}
+	assert.NoError(applyHooks(context.Background(), log, components(remote, hook), o, Opts{AllowRemoteHooks: true}))
+	assert.Equal([]string{"formatted\n", "formatted\n", "unformatted\n", "unformatted\n"}, data(o))
+
+	assert.ErrorIs(applyHooks(context.Background(), log, components(local, Hook{Cmd: "sh", Outputs: []string{"["}}), outputs(), Opts{}), ErrInvalidHook)
+	assert.ErrorIs(applyHooks(context.Background(), log, components(local, Hook{Outputs: []string{"*"}}), outputs(), Opts{}), ErrInvalidHook)
+	assert.Error(applyHooks(context.Background(), log, components(local, Hook{Cmd: "false", Outputs: []string{"*.go"}}), outputs(), Opts{}))
+
+	// hooked outputs are not stale once written
+	dir := t.TempDir()
+	o = outputs()
+	assert.NoError(applyHooks(context.Background(), log, components(local, hook), o, Opts{}))
+	assert.NoError(writeOutputsDir(context.Background(), log, dir, o, nil, false))
+	o = outputs()
+	assert.NoError(applyHooks(context.Background(), log, components(local, hook), o, Opts{}))
+	changes, err := DiffOutputs(kfs.DirFS(dir), o, nil)
+	assert.NoError(err)
+	assert.Len(changes, 0)
+
+	// outputs with skipped hooks are not stale
+	o = outputs()
+	assert.NoError(applyHooks(context.Background(), log, components(local, hook), o, Opts{Check: true}))
+	changes, err = DiffOutputs(kfs.DirFS(dir), o, nil)
+	assert.NoError(err)
+	assert.Len(changes, 0)
+}
+
+func TestSinks(t *testing.T) {
+	t.Parallel()
+
+	outputs := uniqueOutputs([]Output{
+		{Template: Template{Output: "b/file.yaml"}, Kind: OutputKindFile, Mode: 0o644, ModeSet: true, Data: []byte("b: 1")},
+		{Template: Template{Output: "a.yaml"}, Kind: OutputKindFile, Mode: 0o600, ModeSet: true, Data: []byte("a: 1\n")},
+		{Template: Template{Output: "link"}, Kind: OutputKindSymlink, Data: []byte("a.yaml")},
+		{Template: Template{Output: "c"}, Kind: OutputKindDir},
+	})
+
+	t.Run("tar", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		var b bytes.Buffer
+		sink, err := NewSink(SinkKindTar, &b)
+		assert.NoError(err)
+		assert.NoError(sink.Write(context.Background(), outputs))
+
+		r := tar.NewReader(&b)
+		var names []string
+		for {
+			hdr, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			assert.NoError(err)
+			names = append(names, hdr.Name)
+			switch hdr.Name {
+			case "a.yaml":
+				assert.Equal(int64(0o600), hdr.Mode)
+				data, err := io.ReadAll(r)
+				assert.NoError(err)
+				assert.Equal("a: 1\n", string(data))
+			case "link":
+				assert.Equal(byte(tar.TypeSymlink), hdr.Typeflag)
+				assert.Equal("a.yaml", hdr.Linkname)
+			case "c/":
+				assert.Equal(byte(tar.TypeDir), hdr.Typeflag)
 			}
-			assert.NoError(WriteComponents(context.Background(), klog.Discard{}, cache, outputfs, components, io.Discard, false))
+		}
+		assert.Equal([]string{"a.yaml", "b/file.yaml", "c/", "link"}, names)
+	})
+
+	t.Run("zip", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		var b bytes.Buffer
+		sink, err := NewSink(SinkKindZip, &b)
+		assert.NoError(err)
+		assert.NoError(sink.Write(context.Background(), outputs))
+
+		r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+		assert.NoError(err)
+		var names []string
+		for _, i := range r.File {
+			names = append(names, i.Name)
+		}
+		assert.Equal([]string{"a.yaml", "b/file.yaml", "c/", "link"}, names)
+		data, err := fs.ReadFile(r, "b/file.yaml")
+		assert.NoError(err)
+		assert.Equal("b: 1", string(data))
+		assert.Equal(fs.ModeSymlink, r.File[3].Mode().Type())
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		var b bytes.Buffer
+		sink, err := NewSink(SinkKindStream, &b)
+		assert.NoError(err)
+		assert.NoError(sink.Write(context.Background(), outputs))
+		assert.Equal("---\n# anvil output: a.yaml\na: 1\n---\n# anvil output: b/file.yaml\nb: 1\n", b.String())
+	})
 
-			for k, v := range tc.Files {
-				assert.NotNil(outputfs.Fsys[k])
-				assert.Equal(v, string(outputfs.Fsys[k].Data))
+	t.Run("unknown", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		_, err := NewSink("bogus", io.Discard)
+		assert.ErrorIs(err, ErrUnknownSink)
+	})
+}
+
+func TestProvenance(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	local := repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}
+	outputs := []Output{
+		{Spec: local, Dir: "comp", Template: Template{Kind: "jsonnetstr", Path: "script.sh.jsonnet", Output: "bin/script.sh"}, Kind: OutputKindFile, Data: []byte("#!/bin/sh\necho hi\n")},
+		{Spec: local, Dir: "comp", Template: Template{Kind: "staticfile", Path: "conf.yaml", Output: "./conf.yaml"}, Kind: OutputKindFile, Data: []byte("a: 1\n")},
+		{Spec: local, Dir: "comp", Template: Template{Kind: "staticfile", Path: "data.bin", Output: "data.bin"}, Kind: OutputKindFile, Data: []byte("raw")},
+		{Spec: local, Dir: "comp", Template: Template{Output: "link", LinkTarget: "conf.yaml"}, Kind: OutputKindSymlink, Data: []byte("conf.yaml")},
+	}
+
+	provenance, err := OutputsProvenance(outputs, map[string]string{"localdir:localdir": "sum"})
+	assert.NoError(err)
+	assert.Len(provenance, 4)
+	assert.Equal(OutputProvenance{
+		Output:     "bin/script.sh",
+		OutputKind: OutputKindFile,
+		Repo:       "localdir:localdir",
+		RepoKind:   "localdir",
+		RepoSpec:   []byte("{}"),
+		RepoSum:    "sum",
+		Dir:        "comp",
+		Template:   "script.sh.jsonnet",
+		Engine:     "jsonnetstr",
+	}, provenance[0])
+	assert.Equal("conf.yaml", provenance[1].Output)
+	assert.Equal("link", provenance[3].Output)
+	assert.Equal("", provenance[3].Template)
+
+	outputs = addGeneratedHeaders(outputs)
+	assert.Equal("#!/bin/sh\n# Code generated by anvil from localdir:localdir comp/script.sh.jsonnet. DO NOT EDIT.\necho hi\n", string(outputs[0].Data))
+	assert.Equal("# Code generated by anvil from localdir:localdir comp/conf.yaml. DO NOT EDIT.\na: 1\n", string(outputs[1].Data))
+	assert.Equal("raw", string(outputs[2].Data))
+	assert.Equal("conf.yaml", string(outputs[3].Data))
+}
+
+// writeTestFS writes fixture files to a dir on disk for tests of functions
+// that read from the os filesystem
+func writeTestFS(t *testing.T, dir string, fsys fstest.MapFS) {
+	t.Helper()
+	assert := require.New(t)
+	for k, v := range fsys {
+		p := filepath.Join(dir, filepath.FromSlash(k))
+		assert.NoError(os.MkdirAll(filepath.Dir(p), 0o777))
+		mode := v.Mode
+		if mode == 0 {
+			mode = 0o644
+		}
+		assert.NoError(os.WriteFile(p, v.Data, mode))
+	}
+}
+
+func TestGenerateWorkspace(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	writeTestFS(t, dir, fstest.MapFS{
+		"comp/main.jsonnet": &fstest.MapFile{Data: []byte(`
+local anvil = import 'anvil:std';
+local args = anvil.getargs();
+{
+  version: 'xorkevin.dev/anvil/v1alpha2',
+  templates: [
+    { kind: 'jsonnetstr', path: 'msg.jsonnet', args: args, output: 'msg.txt' },
+  ],
+}
+`)},
+		"comp/msg.jsonnet": &fstest.MapFile{Data: []byte(`
+local anvil = import 'anvil:std';
+local args = anvil.getargs();
+'%s %s' % [args.greeting, args.name]
+`)},
+		"greeting.yaml": &fstest.MapFile{Data: []byte("greeting: hello\n")},
+		"anvil.workspace.yaml": &fstest.MapFile{Data: []byte(`
+roots:
+  - input: comp/main.jsonnet
+    output: out/a
+    args_files: [greeting.yaml]
+    args:
+      name: a
+    manifest: a.manifest.json
+  - input: comp/main.jsonnet
+    output: out/b
+    args:
+      greeting: hi
+      name: b
+`)},
+		"bad.workspace.yaml": &fstest.MapFile{Data: []byte(`
+roots:
+  - input: ../comp/main.jsonnet
+    output: out
+`)},
+	})
+
+	ws := filepath.ToSlash(filepath.Join(dir, "anvil.workspace.yaml"))
+	sum := filepath.ToSlash(filepath.Join(dir, "anvil.sum.json"))
+	assert.NoError(GenerateWorkspace(context.Background(), klog.Discard{}, ws, filepath.ToSlash(filepath.Join(dir, "cache")), Opts{
+		RepoChecksumFile: sum,
+		JsonnetLibName:   "anvil:std",
+		Args:             []string{"name=override"},
+	}))
+
+	for k, v := range map[string]string{
+		"out/a/msg.txt":   "hello override",
+		"out/b/msg.txt":   "hi override",
+		"a.manifest.json": `"msg.txt"`,
+		"anvil.sum.json":  `"repos"`,
+	} {
+		b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(k)))
+		assert.NoError(err)
+		assert.Contains(string(b), v)
+	}
+
+	assert.ErrorIs(GenerateWorkspace(context.Background(), klog.Discard{}, filepath.ToSlash(filepath.Join(dir, "bad.workspace.yaml")), "", Opts{}), ErrInvalidWorkspace)
+}
+
+func TestKeepGoing(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	writeTestFS(t, dir, fstest.MapFS{
+		"main.jsonnet": &fstest.MapFile{Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha2',
+  components: [
+    { path: 'good/main.jsonnet' },
+    { path: 'bad/main.jsonnet' },
+    { path: '../outside/main.jsonnet' },
+  ],
+  templates: [
+    { kind: 'jsonnetstr', path: 'fail.jsonnet', output: 'fail.txt' },
+    { kind: 'jsonnetstr', path: 'ok.jsonnet', output: 'ok.txt' },
+  ],
+}
+`)},
+		"fail.jsonnet": &fstest.MapFile{Data: []byte(`error 'template failure'`)},
+		"ok.jsonnet":   &fstest.MapFile{Data: []byte(`'ok'`)},
+		"good/main.jsonnet": &fstest.MapFile{Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha2',
+  templates: [
+    { kind: 'jsonnetstr', path: 'good.jsonnet', output: 'good.txt' },
+  ],
+}
+`)},
+		"good/good.jsonnet":   &fstest.MapFile{Data: []byte(`'good'`)},
+		"bad/main.jsonnet":    &fstest.MapFile{Data: []byte(`error 'config failure'`)},
+		"out/prev.txt":        &fstest.MapFile{Data: []byte("prev")},
+		"anvil.manifest.json": &fstest.MapFile{Data: []byte(`{"output":"` + filepath.ToSlash(filepath.Join(dir, "out")) + `","outputs":["prev.txt"]}`)},
+	})
+
+	report := filepath.ToSlash(filepath.Join(dir, "report.json"))
+	err := Generate(context.Background(), klog.Discard{}, filepath.ToSlash(filepath.Join(dir, "out")), filepath.ToSlash(filepath.Join(dir, "main.jsonnet")), filepath.ToSlash(filepath.Join(dir, "cache")), Opts{
+		ManifestFile:      filepath.ToSlash(filepath.Join(dir, "anvil.manifest.json")),
+		JsonnetLibName:    "anvil:std",
+		KeepGoing:         true,
+		FailureReportFile: report,
+	})
+	assert.ErrorIs(err, ErrGenerateFailed)
+
+	for k, v := range map[string]string{
+		"out/good.txt": "good\n",
+		"out/ok.txt":   "ok\n",
+		// stale outputs are not pruned when there are failures
+		"out/prev.txt": "prev",
+	} {
+		b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(k)))
+		assert.NoError(err)
+		assert.Equal(v, string(b))
+	}
+	_, err = os.Stat(filepath.Join(dir, "out", "fail.txt"))
+	assert.ErrorIs(err, fs.ErrNotExist)
+
+	b, err := os.ReadFile(filepath.FromSlash(report))
+	assert.NoError(err)
+	var data FailureReportData
+	assert.NoError(json.Unmarshal(b, &data))
+	assert.Len(data.Failures, 3)
+	// unresolved subcomponents are failures of their importer
+	assert.Equal(FailureStageParse, data.Failures[0].Stage)
+	assert.Equal("localdir:localdir", data.Failures[0].Repo)
+	assert.Equal(".", data.Failures[0].Dir)
+	assert.Equal("main.jsonnet", data.Failures[0].Path)
+	assert.Contains(data.Failures[0].Error, "Invalid repo dir")
+	assert.Equal(FailureStageParse, data.Failures[1].Stage)
+	assert.Equal("localdir:localdir", data.Failures[1].Repo)
+	assert.Equal("bad", data.Failures[1].Dir)
+	assert.Equal("main.jsonnet", data.Failures[1].Path)
+	assert.Contains(data.Failures[1].Error, "config failure")
+	assert.Equal(FailureStageRender, data.Failures[2].Stage)
+	assert.Equal("fail.jsonnet", data.Failures[2].Path)
+	assert.Equal("fail.txt", data.Failures[2].Output)
+	assert.Contains(data.Failures[2].Error, "template failure")
+}
+
+func TestKeepGoingRootFailure(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	writeTestFS(t, dir, fstest.MapFS{
+		"main.jsonnet": &fstest.MapFile{Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha2',
+  components: [
+    { path: 'bad/main.jsonnet' },
+  ],
+  templates: [
+    { kind: 'jsonnetstr', path: 'ok.jsonnet', output: 'ok.txt' },
+    { kind: 'jsonnetstr', path: 'ok.jsonnet', output: 'ok.txt' },
+  ],
+}
+`)},
+		"ok.jsonnet":       &fstest.MapFile{Data: []byte(`'ok'`)},
+		"bad/main.jsonnet": &fstest.MapFile{Data: []byte(`error 'config failure'`)},
+	})
+
+	// failures collected before the root fails are still reported
+	report := filepath.ToSlash(filepath.Join(dir, "report.json"))
+	err := Generate(context.Background(), klog.Discard{}, filepath.ToSlash(filepath.Join(dir, "out")), filepath.ToSlash(filepath.Join(dir, "main.jsonnet")), filepath.ToSlash(filepath.Join(dir, "cache")), Opts{
+		JsonnetLibName:    "anvil:std",
+		KeepGoing:         true,
+		FailureReportFile: report,
+	})
+	assert.ErrorIs(err, ErrOutputCollision)
+	assert.ErrorIs(err, ErrGenerateFailed)
+
+	b, err := os.ReadFile(filepath.FromSlash(report))
+	assert.NoError(err)
+	var data FailureReportData
+	assert.NoError(json.Unmarshal(b, &data))
+	assert.Len(data.Failures, 1)
+	assert.Equal("bad", data.Failures[0].Dir)
+	assert.Contains(data.Failures[0].Error, "config failure")
+}
+
+func TestReplaceStrict(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	writeTestFS(t, dir, fstest.MapFS{
+		"root/main.jsonnet": &fstest.MapFile{Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha2',
+  components: [
+    { kind: 'git', repo: { repo: 'https://example.com/lib.git', tag: 'v1' }, path: 'a/main.jsonnet' },
+    { kind: 'git', repo: { repo: 'https://example.com/lib.git', branch: 'main' }, path: 'b/main.jsonnet' },
+  ],
+  templates: [],
+}
+`)},
+		"lib/a/main.jsonnet": &fstest.MapFile{Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha2',
+  templates: [
+    { kind: 'jsonnetstr', path: 'a.jsonnet', output: 'a.txt' },
+  ],
+}
+`)},
+		"lib/a/a.jsonnet": &fstest.MapFile{Data: []byte(`'a'`)},
+		"lib/b/main.jsonnet": &fstest.MapFile{Data: []byte(`
+{
+  version: 'xorkevin.dev/anvil/v1alpha2',
+  templates: [
+    { kind: 'jsonnetstr', path: 'b.jsonnet', output: 'b.txt' },
+  ],
+}
+`)},
+		"lib/b/b.jsonnet": &fstest.MapFile{Data: []byte(`'b'`)},
+	})
+
+	sumfile := filepath.ToSlash(filepath.Join(dir, "anvil.sum.json"))
+	// replaced repos are not allowed in strict mode
+	assert.ErrorIs(Generate(context.Background(), klog.Discard{}, filepath.ToSlash(filepath.Join(dir, "out")), filepath.ToSlash(filepath.Join(dir, "root", "main.jsonnet")), filepath.ToSlash(filepath.Join(dir, "cache")), Opts{
+		RepoChecksumFile: sumfile,
+		NoNetwork:        true,
+		JsonnetLibName:   "anvil:std",
+		Replace:          []string{"https://example.com/lib.git=" + filepath.ToSlash(filepath.Join(dir, "lib"))},
+		RepoSumStrict:    true,
+	}), repofetcher.ErrMissingChecksum)
+	_, err := os.Stat(filepath.Join(dir, "out", "a.txt"))
+	assert.ErrorIs(err, fs.ErrNotExist)
+	_, err = os.Stat(filepath.FromSlash(sumfile))
+	assert.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestConfigKinds(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	now := time.Now()
+	var filemode fs.FileMode = 0o644
+
+	cache := newTestCache(&kfstest.MapFS{
+		Fsys: fstest.MapFS{
+			"components/config.yaml": &fstest.MapFile{
+				Data: []byte(`
+version: xorkevin.dev/anvil/v1alpha2
+templates:
+  - kind: staticfile
+    path: a.txt
+    output: a.txt
+components:
+  - path: sub/config.star
+    args:
+      name: b
+  - path: other/config.data
+    config_kind: json
+`),
+				Mode:    filemode,
+				ModTime: now,
+			},
+			"components/sub/config.star": &fstest.MapFile{
+				Data: []byte(`
+def main(args):
+  return {
+    "version": "xorkevin.dev/anvil/v1alpha2",
+    "templates": [
+      {"kind": "staticfile", "path": "b.txt", "output": args["name"] + ".txt"},
+    ],
+  }
+`),
+				Mode:    filemode,
+				ModTime: now,
+			},
+			"components/other/config.data": &fstest.MapFile{
+				Data:    []byte(`{"version": "xorkevin.dev/anvil/v1alpha2", "params": {"name": {"default": "c"}}, "templates": [{"kind": "staticfile", "path": "c.txt", "output": "c.txt"}]}`),
+				Mode:    filemode,
+				ModTime: now,
+			},
+		},
+	})
+
+	components, err := ParseComponents(context.Background(), cache, repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}, "components/config.yaml", nil, io.Discard, 1)
+	assert.NoError(err)
+	assert.Len(components, 3)
+	assert.Equal("components/sub", components[0].Dir)
+	assert.Equal("b.txt", components[0].Templates[0].Output)
+	assert.Equal("components/other", components[1].Dir)
+	assert.Equal("c.txt", components[1].Templates[0].Output)
+	assert.Equal("components", components[2].Dir)
+	assert.Equal("a.txt", components[2].Templates[0].Output)
+
+	// params of configs whose engine cannot evaluate fields are still
+	// validated
+	_, err = ParseComponents(context.Background(), newTestCache(&kfstest.MapFS{
+		Fsys: fstest.MapFS{
+			"components/config.star": &fstest.MapFile{
+				Data: []byte(`
+def main(args):
+  return {
+    "version": "xorkevin.dev/anvil/v1alpha2",
+    "params": {"name": {"required": True}},
+    "templates": [],
+  }
+`),
+				Mode:    filemode,
+				ModTime: now,
+			},
+		},
+	}), repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}, "components/config.star", nil, io.Discard, 1)
+	assert.ErrorIs(err, ErrInvalidArgs)
+
+	// configs which cannot read exports may not name subcomponents
+	_, err = ParseComponents(context.Background(), newTestCache(&kfstest.MapFS{
+		Fsys: fstest.MapFS{
+			"components/config.star": &fstest.MapFile{
+				Data: []byte(`
+def main(args):
+  return {
+    "version": "xorkevin.dev/anvil/v1alpha2",
+    "templates": [],
+    "components": [{"name": "sub", "path": "sub/config.yaml"}],
+  }
+`),
+				Mode:    filemode,
+				ModTime: now,
+			},
+			"components/sub/config.yaml": &fstest.MapFile{
+				Data:    []byte("version: xorkevin.dev/anvil/v1alpha2\ntemplates: []\n"),
+				Mode:    filemode,
+				ModTime: now,
+			},
+		},
+	}), repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}, "components/config.star", nil, io.Discard, 1)
+	assert.ErrorIs(err, ErrInvalidExports)
+
+	// config kinds are not template kinds
+	_, err = cache.Get(context.Background(), configKindYAML, repofetcher.Spec{Kind: "localdir", RepoSpec: localdir.RepoSpec{}}, "components")
+	assert.ErrorIs(err, confengine.ErrNotSupported)
+
+	assert.Equal(configKindJsonnet, configKind("", "config.jsonnet"))
+	assert.Equal(configKindJsonnet, configKind("", "config"))
+	assert.Equal(configKindStarlark, configKind("", "config.star"))
+	assert.Equal(configKindYAML, configKind("yaml", "config.jsonnet"))
+}
+
+func TestParseReplaceFlag(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Flag     string
+		Expected ReplaceData
+		Err      bool
+	}{
+		{
+			Flag:     "github.com/xorkevin/anvil=../anvil",
+			Expected: ReplaceData{Repo: "github.com/xorkevin/anvil", Dir: "../anvil"},
+		},
+		{
+			Flag:     "https://github.com/xorkevin/anvil@v0.1.0=../anvil",
+			Expected: ReplaceData{Repo: "https://github.com/xorkevin/anvil", Tag: "v0.1.0", Dir: "../anvil"},
+		},
+		{
+			Flag:     "git@github.com:xorkevin/anvil.git=/src/anvil",
+			Expected: ReplaceData{Repo: "git@github.com:xorkevin/anvil.git", Dir: "/src/anvil"},
+		},
+		{
+			Flag: "github.com/xorkevin/anvil",
+			Err:  true,
+		},
+	} {
+		t.Run(tc.Flag, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			r, err := parseReplaceFlag(tc.Flag)
+			if tc.Err {
+				assert.ErrorIs(err, ErrInvalidReplace)
+				return
 			}
+			assert.NoError(err)
+			assert.Equal(tc.Expected, r)
 		})
 	}
 }
@@ -6,6 +6,7 @@ import (
 	"io/fs"
 	"net/url"
 	"strings"
+	"sync"
 
 	"xorkevin.dev/anvil/confengine"
 	"xorkevin.dev/anvil/repofetcher"
@@ -24,20 +25,24 @@ func (e errInvalidDir) Error() string {
 }
 
 type (
-	// Cache is a config engine cache by path
+	// Cache is a config engine cache by path. It is safe for concurrent use.
 	Cache struct {
-		repos   *repofetcher.Cache
-		engines confengine.Map
-		cache   map[string]confengine.ConfEngine
+		repos         *repofetcher.Cache
+		engines       confengine.Map
+		configEngines confengine.Map
+		mu            sync.RWMutex
+		cache         map[string]confengine.ConfEngine
 	}
 )
 
-// NewCache creates a new [*Cache]
-func NewCache(repos *repofetcher.Cache, engines confengine.Map) *Cache {
+// NewCache creates a new [*Cache] with template engines and component config
+// engines by kind
+func NewCache(repos *repofetcher.Cache, engines confengine.Map, configEngines confengine.Map) *Cache {
 	return &Cache{
-		repos:   repos,
-		engines: engines,
-		cache:   map[string]confengine.ConfEngine{},
+		repos:         repos,
+		engines:       engines,
+		configEngines: configEngines,
+		cache:         map[string]confengine.ConfEngine{},
 	}
 }
 
@@ -49,8 +54,19 @@ func (c *Cache) Parse(kind string, repobytes []byte) (repofetcher.Spec, error) {
 	return spec, nil
 }
 
-func (c *Cache) cacheKey(kind string, repokey string, dir string) string {
+// Lock returns the fixed repo spec of a possibly floating repo spec
+func (c *Cache) Lock(ctx context.Context, spec repofetcher.Spec) (repofetcher.Spec, error) {
+	spec, err := c.repos.Lock(ctx, spec)
+	if err != nil {
+		return repofetcher.Spec{}, kerrors.WithMsg(err, "Failed to lock repo spec")
+	}
+	return spec, nil
+}
+
+func (c *Cache) cacheKey(class string, kind string, repokey string, dir string) string {
 	var s strings.Builder
+	s.WriteString(class)
+	s.WriteString(":")
 	s.WriteString(url.QueryEscape(kind))
 	s.WriteString(":")
 	s.WriteString(repokey)
@@ -59,7 +75,17 @@ func (c *Cache) cacheKey(kind string, repokey string, dir string) string {
 	return s.String()
 }
 
+// Get returns the template engine of a kind for a repo dir
 func (c *Cache) Get(ctx context.Context, kind string, spec repofetcher.Spec, dir string) (confengine.ConfEngine, error) {
+	return c.get(ctx, "template", c.engines, kind, spec, dir)
+}
+
+// GetConfig returns the component config engine of a kind for a repo dir
+func (c *Cache) GetConfig(ctx context.Context, kind string, spec repofetcher.Spec, dir string) (confengine.ConfEngine, error) {
+	return c.get(ctx, "config", c.configEngines, kind, spec, dir)
+}
+
+func (c *Cache) get(ctx context.Context, class string, engines confengine.Map, kind string, spec repofetcher.Spec, dir string) (confengine.ConfEngine, error) {
 	fsys, err := c.repos.Get(ctx, spec)
 	if err != nil {
 		return nil, kerrors.WithMsg(err, "Failed to fetch repo")
@@ -68,18 +94,31 @@ func (c *Cache) Get(ctx context.Context, kind string, spec repofetcher.Spec, dir
 	if !fs.ValidPath(dir) {
 		return nil, kerrors.WithKind(nil, ErrInvalidDir, fmt.Sprintf("Invalid repo dir %s for repo %s", dir, repokey))
 	}
-	cachekey := c.cacheKey(kind, repokey, dir)
-	if eng, ok := c.cache[cachekey]; ok {
+	cachekey := c.cacheKey(class, kind, repokey, dir)
+	if eng, ok := c.getCached(cachekey); ok {
 		return eng, nil
 	}
 	fsys, err = fs.Sub(fsys, dir)
 	if err != nil {
 		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to get subdirectory %s for repo %s", dir, repokey))
 	}
-	eng, err := c.engines.Build(kind, fsys)
+	eng, err := engines.Build(kind, fsys)
 	if err != nil {
-		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to build %s config engine for repo %s at dir %s", kind, repokey, dir))
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to build %s %s engine for repo %s at dir %s", kind, class, repokey, dir))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, ok := c.cache[cachekey]; ok {
+		// another caller built the engine concurrently
+		return existing, nil
 	}
 	c.cache[cachekey] = eng
 	return eng, nil
 }
+
+func (c *Cache) getCached(cachekey string) (confengine.ConfEngine, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	eng, ok := c.cache[cachekey]
+	return eng, ok
+}
@@ -0,0 +1,227 @@
+package component
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+
+	"xorkevin.dev/anvil/util/udiff"
+	"xorkevin.dev/kerrors"
+	"xorkevin.dev/kfs"
+)
+
+const (
+	// OutputChangeCreate is a new output
+	OutputChangeCreate = "create"
+	// OutputChangeUpdate is a modified output
+	OutputChangeUpdate = "update"
+	// OutputChangeDelete is a pruned output
+	OutputChangeDelete = "delete"
+)
+
+type (
+	// OutputChange is a change to an output in an fs
+	OutputChange struct {
+		Kind    string
+		Path    string
+		Old     []byte
+		New     []byte
+		OldMode fs.FileMode
+		NewMode fs.FileMode
+	}
+
+	existingOutput struct {
+		kind string
+		mode fs.FileMode
+		data []byte
+	}
+)
+
+// outputDiffData returns the content of an output to be diffed
+func outputDiffData(kind string, data []byte) []byte {
+	switch kind {
+	case OutputKindSymlink:
+		return []byte("symlink " + string(data) + "\n")
+	case OutputKindDir:
+		return []byte("directory\n")
+	default:
+		return data
+	}
+}
+
+func readExistingOutput(fsys fs.FS, name string) (*existingOutput, error) {
+	info, err := lstatOutput(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, nil
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := kfs.ReadLink(fsys, name)
+		if err != nil {
+			return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed reading existing symlink output %s", name))
+		}
+		return &existingOutput{
+			kind: OutputKindSymlink,
+			data: []byte(target),
+		}, nil
+	}
+	if info.IsDir() {
+		return &existingOutput{
+			kind: OutputKindDir,
+			mode: info.Mode().Perm(),
+		}, nil
+	}
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed reading existing output %s", name))
+	}
+	return &existingOutput{
+		kind: OutputKindFile,
+		mode: info.Mode().Perm(),
+		data: b,
+	}, nil
+}
+
+// uniqueOutputs returns the outputs sorted by path with only the last output
+// for each path, since later outputs overwrite earlier ones when written
+func uniqueOutputs(outputs []Output) []Output {
+	rendered := map[string]Output{}
+	for _, i := range outputs {
+		rendered[path.Clean(i.Template.Output)] = i
+	}
+	paths := make([]string, 0, len(rendered))
+	for k := range rendered {
+		paths = append(paths, k)
+	}
+	slices.Sort(paths)
+	res := make([]Output, 0, len(paths))
+	for _, i := range paths {
+		res = append(res, rendered[i])
+	}
+	return res
+}
+
+// outputChange returns the change that writing an output would make to an fs
+// and the existing entry, or the empty string if the output is identical to
+// the existing entry
+func outputChange(fsys fs.FS, output Output) (string, *existingOutput, error) {
+	existing, err := readExistingOutput(fsys, output.Template.Output)
+	if err != nil {
+		return "", nil, err
+	}
+	if existing == nil {
+		return OutputChangeCreate, nil, nil
+	}
+	if existing.kind != output.Kind {
+		return OutputChangeUpdate, existing, nil
+	}
+	switch output.Kind {
+	case OutputKindFile:
+		if !bytes.Equal(existing.data, output.Data) || output.ModeSet && existing.mode != output.Mode {
+			return OutputChangeUpdate, existing, nil
+		}
+	case OutputKindSymlink:
+		if !bytes.Equal(existing.data, output.Data) {
+			return OutputChangeUpdate, existing, nil
+		}
+	}
+	return "", existing, nil
+}
+
+// DiffOutputs computes the changes that writing rendered outputs and pruning
+// stale previous outputs would make to an fs. The content of existing outputs
+// with skipped hooks is assumed to be up to date.
+func DiffOutputs(fsys fs.FS, outputs []Output, prev []string) ([]OutputChange, error) {
+	outputs = uniqueOutputs(outputs)
+	paths := make([]string, 0, len(outputs))
+	for _, i := range outputs {
+		paths = append(paths, path.Clean(i.Template.Output))
+	}
+
+	var changes []OutputChange
+	for n, i := range paths {
+		output := outputs[n]
+		newData := outputDiffData(output.Kind, output.Data)
+		existing, err := readExistingOutput(fsys, i)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			changes = append(changes, OutputChange{
+				Kind: OutputChangeCreate,
+				Path: i,
+				New:  newData,
+			})
+			continue
+		}
+		change := OutputChange{
+			Kind: OutputChangeUpdate,
+			Path: i,
+			Old:  outputDiffData(existing.kind, existing.data),
+			New:  newData,
+		}
+		if output.HookSkipped && existing.kind == output.Kind {
+			// the content of an output with skipped hooks is not known, so the
+			// existing content is assumed
+			change.New = change.Old
+		}
+		// dir modes are only applied on creation
+		if output.ModeSet && output.Kind == OutputKindFile && existing.kind == OutputKindFile && existing.mode != output.Mode {
+			change.OldMode = existing.mode
+			change.NewMode = output.Mode
+		}
+		if change.OldMode != change.NewMode || !bytes.Equal(change.Old, change.New) {
+			changes = append(changes, change)
+		}
+	}
+	for _, i := range StaleOutputs(prev, paths) {
+		if !fs.ValidPath(i) {
+			return nil, kerrors.WithKind(nil, ErrInvalidOutput, fmt.Sprintf("Invalid stale output path %s", i))
+		}
+		existing, err := readExistingOutput(fsys, i)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			continue
+		}
+		changes = append(changes, OutputChange{
+			Kind: OutputChangeDelete,
+			Path: i,
+			Old:  outputDiffData(existing.kind, existing.data),
+		})
+	}
+	slices.SortStableFunc(changes, func(a, b OutputChange) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return changes, nil
+}
+
+// WriteDiff writes output changes as a unified diff
+func WriteDiff(w io.Writer, changes []OutputChange) error {
+	for _, i := range changes {
+		oldName := "a/" + i.Path
+		newName := "b/" + i.Path
+		switch i.Kind {
+		case OutputChangeCreate:
+			oldName = "/dev/null"
+		case OutputChangeDelete:
+			newName = "/dev/null"
+		}
+		if i.OldMode != i.NewMode {
+			if _, err := fmt.Fprintf(w, "mode change %04o => %04o %s\n", i.OldMode, i.NewMode, i.Path); err != nil {
+				return kerrors.WithMsg(err, "Failed writing diff")
+			}
+		}
+		if _, err := io.WriteString(w, udiff.Unified(oldName, newName, i.Old, i.New, 3)); err != nil {
+			return kerrors.WithMsg(err, "Failed writing diff")
+		}
+	}
+	return nil
+}
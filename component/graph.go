@@ -0,0 +1,206 @@
+package component
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"xorkevin.dev/anvil/repofetcher"
+	"xorkevin.dev/anvil/util/kjson"
+	"xorkevin.dev/kerrors"
+)
+
+var (
+	// ErrUnknownGraphFormat is returned when the graph format is not supported
+	ErrUnknownGraphFormat errUnknownGraphFormat
+)
+
+type (
+	errUnknownGraphFormat struct{}
+)
+
+func (e errUnknownGraphFormat) Error() string {
+	return "Unknown graph format"
+}
+
+const (
+	// GraphFormatDot is the graphviz dot graph format
+	GraphFormatDot = "dot"
+	// GraphFormatJSON is the json graph format
+	GraphFormatJSON = "json"
+)
+
+type (
+	// Graph is a resolved component dependency graph
+	Graph struct {
+		Nodes []GraphNode `json:"nodes"`
+		Edges []GraphEdge `json:"edges"`
+	}
+
+	// GraphNode is a component config with particular args
+	GraphNode struct {
+		ID       string `json:"id"`
+		Repo     string `json:"repo"`
+		Dir      string `json:"dir"`
+		Name     string `json:"name"`
+		ArgsHash string `json:"args_hash"`
+	}
+
+	// GraphEdge is an import of a component config by another
+	GraphEdge struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+
+	graphBuilder struct {
+		mu    sync.Mutex
+		nodes map[string]GraphNode
+		edges map[GraphEdge]struct{}
+	}
+)
+
+func newGraphBuilder() *graphBuilder {
+	return &graphBuilder{
+		nodes: map[string]GraphNode{},
+		edges: map[GraphEdge]struct{}{},
+	}
+}
+
+// argsHash returns a stable hash of component args
+func argsHash(args map[string]any) (string, error) {
+	if args == nil {
+		args = map[string]any{}
+	}
+	// map keys are marshaled in sorted order
+	b, err := kjson.Marshal(args)
+	if err != nil {
+		return "", kerrors.WithMsg(err, "Failed to marshal component args")
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+func graphNodeID(spec repofetcher.Spec, dir, name string, hash string) string {
+	return componentKey(spec, dir, name) + "#" + hash
+}
+
+func (g *graphBuilder) addNode(node GraphNode) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.nodes[node.ID] = node
+}
+
+func (g *graphBuilder) addEdge(from, to string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.edges[GraphEdge{From: from, To: to}] = struct{}{}
+}
+
+func (g *graphBuilder) graph() *Graph {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	nodes := make([]GraphNode, 0, len(g.nodes))
+	for _, v := range g.nodes {
+		nodes = append(nodes, v)
+	}
+	slices.SortFunc(nodes, func(a, b GraphNode) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	edges := make([]GraphEdge, 0, len(g.edges))
+	for k := range g.edges {
+		edges = append(edges, k)
+	}
+	slices.SortFunc(edges, func(a, b GraphEdge) int {
+		if c := strings.Compare(a.From, b.From); c != 0 {
+			return c
+		}
+		return strings.Compare(a.To, b.To)
+	})
+	return &Graph{
+		Nodes: nodes,
+		Edges: edges,
+	}
+}
+
+// ParseGraph parses component configs and returns the resolved dependency
+// graph
+func ParseGraph(ctx context.Context, cache *Cache, spec repofetcher.Spec, name string, args map[string]any, stderr io.Writer, jobs int) (*Graph, error) {
+	p := newParser(cache, stderr, jobs, nil)
+	if _, err := p.parse(ctx, spec, name, args); err != nil {
+		return nil, err
+	}
+	return p.graph.graph(), nil
+}
+
+// WriteGraph writes a graph in a format
+func WriteGraph(w io.Writer, g *Graph, format string) error {
+	switch format {
+	case GraphFormatDot:
+		return writeGraphDot(w, g)
+	case GraphFormatJSON:
+		b, err := kjson.Marshal(g)
+		if err != nil {
+			return kerrors.WithMsg(err, "Failed to marshal graph")
+		}
+		var f bytes.Buffer
+		if err := json.Indent(&f, b, "", "  "); err != nil {
+			return kerrors.WithMsg(err, "Failed to indent graph")
+		}
+		if _, err := f.WriteTo(w); err != nil {
+			return kerrors.WithMsg(err, "Failed writing graph")
+		}
+		return nil
+	default:
+		return kerrors.WithKind(nil, ErrUnknownGraphFormat, fmt.Sprintf("Unknown graph format: %s", format))
+	}
+}
+
+// dotEscaper escapes the characters that are special within a DOT quoted
+// string
+var dotEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+
+// dotQuote returns s as a DOT quoted string
+func dotQuote(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
+
+// dotLabel returns a DOT quoted label of lines, which are separated by the
+// DOT centered line break escape
+func dotLabel(lines ...string) string {
+	escaped := make([]string, 0, len(lines))
+	for _, i := range lines {
+		escaped = append(escaped, dotEscaper.Replace(i))
+	}
+	return `"` + strings.Join(escaped, `\n`) + `"`
+}
+
+func writeGraphDot(w io.Writer, g *Graph) error {
+	var b strings.Builder
+	b.WriteString("digraph components {\n")
+	for _, i := range g.Nodes {
+		b.WriteString("  ")
+		b.WriteString(dotQuote(i.ID))
+		b.WriteString(" [label=")
+		b.WriteString(dotLabel(i.Repo, strings.TrimPrefix(i.Dir+"/"+i.Name, "./"), fmt.Sprintf("args %.12s", i.ArgsHash)))
+		b.WriteString("];\n")
+	}
+	for _, i := range g.Edges {
+		b.WriteString("  ")
+		b.WriteString(dotQuote(i.From))
+		b.WriteString(" -> ")
+		b.WriteString(dotQuote(i.To))
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return kerrors.WithMsg(err, "Failed writing graph")
+	}
+	return nil
+}
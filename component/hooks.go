@@ -0,0 +1,230 @@
+package component
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"xorkevin.dev/kerrors"
+	"xorkevin.dev/klog"
+)
+
+var (
+	// ErrInvalidHook is returned when a hook declaration is invalid
+	ErrInvalidHook errInvalidHook
+)
+
+type (
+	errInvalidHook struct{}
+)
+
+func (e errInvalidHook) Error() string {
+	return "Invalid hook"
+}
+
+type (
+	// Hook is a command run on rendered file outputs before they are compared
+	// or written. Outputs are globs of output paths where a ** segment matches
+	// any number of path segments. Hooks of local components match the outputs
+	// of every component, and hooks of remote components match only the
+	// outputs of their own component.
+	Hook struct {
+		Cmd     string   `json:"cmd"`
+		Args    []string `json:"args"`
+		Outputs []string `json:"outputs"`
+	}
+)
+
+// matchGlob reports whether name matches the slash separated glob pattern. A
+// ** segment matches zero or more path segments, and all other segments are
+// matched with [path.Match].
+func matchGlob(pattern, name string) (bool, error) {
+	segments := strings.Split(pattern, "/")
+	for _, i := range segments {
+		if i == "**" {
+			continue
+		}
+		if _, err := path.Match(i, ""); err != nil {
+			return false, err
+		}
+	}
+	return matchGlobSegments(segments, strings.Split(name, "/")), nil
+}
+
+func matchGlobSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchGlobSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		// pattern segments are validated by matchGlob
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchHookOutputs returns the outputs matching any of the hook output globs
+func matchHookOutputs(hook Hook, outputs []string) ([]string, error) {
+	var matched []string
+	for _, i := range outputs {
+		for _, j := range hook.Outputs {
+			ok, err := matchGlob(j, i)
+			if err != nil {
+				return nil, kerrors.WithKind(err, ErrInvalidHook, fmt.Sprintf("Invalid hook output glob: %s", j))
+			}
+			if ok {
+				matched = append(matched, i)
+				break
+			}
+		}
+	}
+	return matched, nil
+}
+
+type (
+	hookOutputKey struct {
+		spec   string
+		dir    string
+		output string
+	}
+)
+
+// applyHooks runs the hooks of components on the rendered file outputs that
+// match their output globs, replacing the output data with the result. Hooks
+// of local components match every output, such as to format the outputs of
+// remote subcomponents, while hooks of remote components only match outputs
+// of their own component. Hooks are run in component order in a temporary dir
+// holding the matching outputs at their output paths, with the output paths
+// appended to their args. Hooks from non-local repos are skipped unless
+// explicitly allowed. In dry run and check mode, hooks are listed rather than
+// run, and the outputs they match are marked as having skipped hooks.
+func applyHooks(ctx context.Context, log *klog.LevelLogger, components []Component, outputs []Output, opts Opts) error {
+	if opts.NoHooks {
+		return nil
+	}
+	owners := map[hookOutputKey]int{}
+	for n, i := range components {
+		for _, j := range i.Templates {
+			k := hookOutputKey{spec: i.Spec.String(), dir: i.Dir, output: path.Clean(j.Output)}
+			if _, ok := owners[k]; !ok {
+				owners[k] = n
+			}
+		}
+	}
+	var all []int
+	owned := make([][]int, len(components))
+	for n, i := range outputs {
+		if i.Kind != OutputKindFile {
+			continue
+		}
+		all = append(all, n)
+		if c, ok := owners[hookOutputKey{spec: i.Spec.String(), dir: i.Dir, output: path.Clean(i.Template.Output)}]; ok {
+			owned[c] = append(owned[c], n)
+		}
+	}
+	for n, i := range components {
+		for _, j := range i.Hooks {
+			hctx := klog.CtxWithAttrs(ctx, klog.AString("repo", i.Spec.String()), klog.AString("dir", i.Dir), klog.AString("hook", j.Cmd))
+			if j.Cmd == "" {
+				return kerrors.WithKind(nil, ErrInvalidHook, fmt.Sprintf("Hook in %s %s is missing a cmd", i.Spec, i.Dir))
+			}
+			candidates := all
+			if i.Spec.Kind != repoKindLocalDir {
+				if !opts.AllowRemoteHooks {
+					log.Warn(hctx, "Skipping hook from remote repo without allowing remote hooks")
+					continue
+				}
+				candidates = owned[n]
+			}
+			paths := make([]string, 0, len(candidates))
+			byPath := map[string]int{}
+			for _, k := range candidates {
+				p := path.Clean(outputs[k].Template.Output)
+				if _, ok := byPath[p]; !ok {
+					paths = append(paths, p)
+				}
+				// only the last output written to a path determines its content
+				byPath[p] = k
+			}
+			matched, err := matchHookOutputs(j, paths)
+			if err != nil {
+				return kerrors.WithMsg(err, fmt.Sprintf("Invalid hook in %s %s", i.Spec, i.Dir))
+			}
+			if len(matched) == 0 {
+				log.Debug(hctx, "Skipping hook with no matching outputs")
+				continue
+			}
+			if opts.DryRun || opts.Check {
+				log.Info(hctx, "Dry run hook", klog.AString("args", strings.Join(j.Args, " ")), klog.AString("outputs", strings.Join(matched, " ")))
+				for _, k := range matched {
+					outputs[byPath[k]].HookSkipped = true
+				}
+				continue
+			}
+			if err := runHook(ctx, j, outputs, matched, byPath); err != nil {
+				return kerrors.WithMsg(err, fmt.Sprintf("Failed running hook %s in %s %s", j.Cmd, i.Spec, i.Dir))
+			}
+			log.Debug(hctx, "Ran hook", klog.AInt("outputs", len(matched)))
+		}
+	}
+	return nil
+}
+
+// runHook runs a hook in a temporary dir on the matched outputs and reads
+// back their data
+func runHook(ctx context.Context, hook Hook, outputs []Output, matched []string, byPath map[string]int) (retErr error) {
+	dir, err := os.MkdirTemp("", "anvil-hook-")
+	if err != nil {
+		return kerrors.WithMsg(err, "Failed creating hook dir")
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			retErr = errors.Join(retErr, kerrors.WithMsg(err, fmt.Sprintf("Failed removing hook dir %s", dir)))
+		}
+	}()
+	for _, i := range matched {
+		if !fs.ValidPath(i) {
+			return kerrors.WithKind(nil, ErrInvalidOutput, fmt.Sprintf("Invalid hook output path %s", i))
+		}
+		name := filepath.Join(dir, filepath.FromSlash(i))
+		if err := os.MkdirAll(filepath.Dir(name), 0o777); err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Failed creating hook output dir for %s", i))
+		}
+		if err := os.WriteFile(name, outputs[byPath[i]].Data, 0o644); err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Failed writing hook output %s", i))
+		}
+	}
+	args := append(append([]string{}, hook.Args...), matched...)
+	cmd := exec.CommandContext(ctx, hook.Cmd, args...)
+	cmd.Dir = dir
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return kerrors.WithMsg(err, "Hook failed")
+	}
+	for _, i := range matched {
+		b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(i)))
+		if err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Failed reading hook output %s", i))
+		}
+		outputs[byPath[i]].Data = b
+	}
+	return nil
+}
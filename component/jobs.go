@@ -0,0 +1,45 @@
+package component
+
+import (
+	"context"
+	"sync"
+)
+
+// runJobs runs fn for each index in [0, n) with at most jobs running
+// concurrently. Every index is run regardless of failures so that the
+// returned error, which is the error of the lowest failing index, is
+// deterministic.
+func runJobs(ctx context.Context, jobs int, n int, fn func(ctx context.Context, i int) error) error {
+	if jobs <= 1 || n <= 1 {
+		for i := 0; i < n; i++ {
+			if err := fn(ctx, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	errs := make([]error, n)
+	idx := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(jobs, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				errs[i] = fn(ctx, i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
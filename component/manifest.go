@@ -0,0 +1,151 @@
+package component
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+
+	"xorkevin.dev/anvil/util/kjson"
+	"xorkevin.dev/kerrors"
+	"xorkevin.dev/kfs"
+	"xorkevin.dev/klog"
+)
+
+type (
+	// ManifestData is the shape of a generated output manifest file
+	ManifestData struct {
+		Output  string   `json:"output"`
+		Outputs []string `json:"outputs"`
+	}
+)
+
+func parseManifestFile(name string) (*ManifestData, error) {
+	b, err := os.ReadFile(filepath.FromSlash(name))
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to read manifest file: %s", name))
+	}
+	var data ManifestData
+	if err := kjson.Unmarshal(b, &data); err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Malformed manifest file: %s", name))
+	}
+	return &data, nil
+}
+
+func writeManifestFile(name string, data ManifestData) error {
+	b, err := kjson.Marshal(data)
+	if err != nil {
+		return kerrors.WithMsg(err, "Failed to construct manifest data")
+	}
+	var f bytes.Buffer
+	if err := json.Indent(&f, b, "", "  "); err != nil {
+		return kerrors.WithMsg(err, "Failed to indent manifest file")
+	}
+	if err := os.WriteFile(filepath.FromSlash(name), f.Bytes(), 0o644); err != nil {
+		return kerrors.WithMsg(err, fmt.Sprintf("Failed to write manifest file: %s", name))
+	}
+	return nil
+}
+
+// ComponentOutputs returns the sorted unique output paths of components
+func ComponentOutputs(components []Component) []string {
+	set := map[string]struct{}{}
+	for _, i := range components {
+		for _, j := range i.Templates {
+			set[path.Clean(j.Output)] = struct{}{}
+		}
+	}
+	outputs := make([]string, 0, len(set))
+	for k := range set {
+		outputs = append(outputs, k)
+	}
+	slices.Sort(outputs)
+	return outputs
+}
+
+// StaleOutputs returns the sorted paths in prev that are not in outputs
+func StaleOutputs(prev []string, outputs []string) []string {
+	set := make(map[string]struct{}, len(outputs))
+	for _, i := range outputs {
+		set[path.Clean(i)] = struct{}{}
+	}
+	stale := map[string]struct{}{}
+	for _, i := range prev {
+		p := path.Clean(i)
+		if _, ok := set[p]; ok {
+			continue
+		}
+		stale[p] = struct{}{}
+	}
+	res := make([]string, 0, len(stale))
+	for k := range stale {
+		res = append(res, k)
+	}
+	slices.Sort(res)
+	return res
+}
+
+func removeEmptyParents(fsys fs.FS, p string) error {
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		entries, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return kerrors.WithMsg(err, fmt.Sprintf("Failed reading output dir %s", dir))
+		}
+		if len(entries) != 0 {
+			return nil
+		}
+		if err := kfs.Remove(fsys, dir); err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Failed removing empty output dir %s", dir))
+		}
+	}
+	return nil
+}
+
+// PruneOutputs removes previously generated outputs that are no longer generated
+func PruneOutputs(ctx context.Context, log klog.Logger, fsys fs.FS, prev []string, outputs []string, dryrun bool) error {
+	l := klog.NewLevelLogger(log)
+	for _, i := range StaleOutputs(prev, outputs) {
+		if !fs.ValidPath(i) {
+			return kerrors.WithKind(nil, ErrInvalidOutput, fmt.Sprintf("Invalid stale output path %s", i))
+		}
+		info, err := lstatOutput(fsys, i)
+		if err != nil {
+			return err
+		}
+		if info == nil {
+			l.Info(ctx, "Stale output already removed", klog.AString("output", i))
+			continue
+		}
+		if info.IsDir() {
+			entries, err := fs.ReadDir(fsys, i)
+			if err != nil {
+				return kerrors.WithMsg(err, fmt.Sprintf("Failed reading stale dir output %s", i))
+			}
+			if len(entries) != 0 {
+				l.Warn(ctx, "Skipping pruning non-empty dir output", klog.AString("output", i))
+				continue
+			}
+		}
+		if dryrun {
+			l.Info(ctx, "Dry run prune output", klog.AString("output", i))
+			continue
+		}
+		if err := kfs.Remove(fsys, i); err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Failed pruning stale output %s", i))
+		}
+		if err := removeEmptyParents(fsys, i); err != nil {
+			return err
+		}
+		l.Info(ctx, "Pruned output", klog.AString("output", i))
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package component
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"xorkevin.dev/kerrors"
+)
+
+const (
+	paramsField = "params"
+)
+
+const (
+	// ParamTypeAny accepts any arg value
+	ParamTypeAny = "any"
+	// ParamTypeString accepts a string arg
+	ParamTypeString = "string"
+	// ParamTypeNumber accepts a number arg
+	ParamTypeNumber = "number"
+	// ParamTypeBool accepts a boolean arg
+	ParamTypeBool = "bool"
+	// ParamTypeArray accepts an array arg
+	ParamTypeArray = "array"
+	// ParamTypeObject accepts an object arg
+	ParamTypeObject = "object"
+)
+
+type (
+	// Param is a declared component config parameter
+	Param struct {
+		Type        string `json:"type"`
+		Required    bool   `json:"required"`
+		Default     any    `json:"default"`
+		Description string `json:"description"`
+	}
+)
+
+func checkParamType(kind string, v any) (bool, error) {
+	switch kind {
+	case "", ParamTypeAny:
+		return true, nil
+	case ParamTypeString:
+		_, ok := v.(string)
+		return ok, nil
+	case ParamTypeNumber:
+		switch v.(type) {
+		case float64, float32, int, int64, int32, uint, uint64, uint32, json.Number:
+			return true, nil
+		}
+		return false, nil
+	case ParamTypeBool:
+		_, ok := v.(bool)
+		return ok, nil
+	case ParamTypeArray:
+		_, ok := v.([]any)
+		return ok, nil
+	case ParamTypeObject:
+		_, ok := v.(map[string]any)
+		return ok, nil
+	default:
+		return false, kerrors.WithKind(nil, ErrInvalidArgs, fmt.Sprintf("Unknown param type: %s", kind))
+	}
+}
+
+// applyParams validates args against declared params and returns args with
+// defaults applied
+func applyParams(params map[string]Param, args map[string]any) (map[string]any, error) {
+	if params == nil {
+		return args, nil
+	}
+
+	var unknown []string
+	for k := range args {
+		if _, ok := params[k]; !ok {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) != 0 {
+		slices.Sort(unknown)
+		return nil, kerrors.WithKind(nil, ErrInvalidArgs, fmt.Sprintf("Unknown args: %s", strings.Join(unknown, ", ")))
+	}
+
+	names := make([]string, 0, len(params))
+	for k := range params {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+
+	res := make(map[string]any, len(params))
+	for _, k := range names {
+		param := params[k]
+		if param.Required && param.Default != nil {
+			return nil, kerrors.WithKind(nil, ErrInvalidArgs, fmt.Sprintf("Required param %s may not have a default", k))
+		}
+		v, ok := args[k]
+		if !ok {
+			if param.Required {
+				return nil, kerrors.WithKind(nil, ErrInvalidArgs, fmt.Sprintf("Missing required arg %s", k))
+			}
+			if param.Default == nil {
+				continue
+			}
+			ok, err := checkParamType(param.Type, param.Default)
+			if err != nil {
+				return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid param %s", k))
+			}
+			if !ok {
+				return nil, kerrors.WithKind(nil, ErrInvalidArgs, fmt.Sprintf("Default of param %s is not of type %s", k, param.Type))
+			}
+			res[k] = param.Default
+			continue
+		}
+		ok, err := checkParamType(param.Type, v)
+		if err != nil {
+			return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid param %s", k))
+		}
+		if !ok {
+			return nil, kerrors.WithKind(nil, ErrInvalidArgs, fmt.Sprintf("Arg %s is not of type %s", k, param.Type))
+		}
+		res[k] = v
+	}
+	return res, nil
+}
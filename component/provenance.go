@@ -0,0 +1,205 @@
+package component
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"xorkevin.dev/anvil/util/kjson"
+	"xorkevin.dev/kerrors"
+	"xorkevin.dev/klog"
+)
+
+type (
+	// ProvenanceData is the shape of a generated output provenance file
+	ProvenanceData struct {
+		Outputs []OutputProvenance `json:"outputs"`
+	}
+
+	// OutputProvenance describes where a generated output came from
+	OutputProvenance struct {
+		Output     string          `json:"output"`
+		OutputKind string          `json:"output_kind"`
+		Repo       string          `json:"repo"`
+		RepoKind   string          `json:"repo_kind"`
+		RepoSpec   json.RawMessage `json:"repo_spec"`
+		RepoSum    string          `json:"repo_sum,omitempty"`
+		Dir        string          `json:"dir"`
+		Template   string          `json:"template,omitempty"`
+		Engine     string          `json:"engine,omitempty"`
+	}
+)
+
+// OutputsProvenance returns the provenance of unique outputs sorted by path.
+// Repo sums are keyed by repo.
+func OutputsProvenance(outputs []Output, sums map[string]string) ([]OutputProvenance, error) {
+	outputs = uniqueOutputs(outputs)
+	res := make([]OutputProvenance, 0, len(outputs))
+	for _, i := range outputs {
+		repospec, err := marshalRepoSpec(i.Spec)
+		if err != nil {
+			return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to marshal repo spec for output %s", i.Template.Output))
+		}
+		repo := i.Spec.String()
+		p := OutputProvenance{
+			Output:     path.Clean(i.Template.Output),
+			OutputKind: i.Kind,
+			Repo:       repo,
+			RepoKind:   i.Spec.Kind,
+			RepoSpec:   repospec,
+			RepoSum:    sums[repo],
+			Dir:        i.Dir,
+		}
+		if i.Kind == OutputKindFile {
+			p.Template = i.Template.Path
+			p.Engine = i.Template.Kind
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+func writeProvenanceFile(name string, data ProvenanceData) error {
+	b, err := kjson.Marshal(data)
+	if err != nil {
+		return kerrors.WithMsg(err, "Failed to construct provenance data")
+	}
+	var f bytes.Buffer
+	if err := json.Indent(&f, b, "", "  "); err != nil {
+		return kerrors.WithMsg(err, "Failed to indent provenance file")
+	}
+	if err := os.WriteFile(filepath.FromSlash(name), f.Bytes(), 0o644); err != nil {
+		return kerrors.WithMsg(err, fmt.Sprintf("Failed to write provenance file: %s", name))
+	}
+	return nil
+}
+
+func writeProvenance(ctx context.Context, log *klog.LevelLogger, cache *Cache, outputs []Output, opts Opts) error {
+	if opts.ProvenanceFile == "" {
+		return nil
+	}
+	if opts.DryRun {
+		log.Info(ctx, "Dry run write provenance file", klog.AString("file", opts.ProvenanceFile))
+		return nil
+	}
+	sums := map[string]string{}
+	for _, i := range cache.repos.Sums() {
+		sums[i.Key] = i.Sum
+	}
+	provenance, err := OutputsProvenance(outputs, sums)
+	if err != nil {
+		return err
+	}
+	if err := writeProvenanceFile(opts.ProvenanceFile, ProvenanceData{
+		Outputs: provenance,
+	}); err != nil {
+		return kerrors.WithMsg(err, fmt.Sprintf("Failed writing provenance file: %s", opts.ProvenanceFile))
+	}
+	log.Info(ctx, "Wrote provenance file", klog.AString("file", opts.ProvenanceFile))
+	return nil
+}
+
+type (
+	commentStyle struct {
+		prefix string
+		suffix string
+	}
+)
+
+var (
+	commentHash  = commentStyle{prefix: "# "}
+	commentSlash = commentStyle{prefix: "// "}
+	commentDash  = commentStyle{prefix: "-- "}
+	commentXML   = commentStyle{prefix: "<!-- ", suffix: " -->"}
+)
+
+// headerCommentStyles are the comment styles of known file types by extension
+var headerCommentStyles = map[string]commentStyle{
+	".yaml":      commentHash,
+	".yml":       commentHash,
+	".toml":      commentHash,
+	".sh":        commentHash,
+	".bash":      commentHash,
+	".py":        commentHash,
+	".tf":        commentHash,
+	".hcl":       commentHash,
+	".conf":      commentHash,
+	".star":      commentHash,
+	".go":        commentSlash,
+	".js":        commentSlash,
+	".ts":        commentSlash,
+	".jsonnet":   commentSlash,
+	".libsonnet": commentSlash,
+	".rs":        commentSlash,
+	".java":      commentSlash,
+	".c":         commentSlash,
+	".h":         commentSlash,
+	".sql":       commentDash,
+	".lua":       commentDash,
+	".html":      commentXML,
+	".xml":       commentXML,
+	".md":        commentXML,
+}
+
+// generatedHeader returns the generated by header line for an output, or
+// false if the output is not of a known file type
+func generatedHeader(output Output) (string, bool) {
+	style, ok := headerCommentStyles[path.Ext(output.Template.Output)]
+	if !ok {
+		return "", false
+	}
+	// matches the go generated code convention
+	return fmt.Sprintf("%sCode generated by anvil from %s %s. DO NOT EDIT.%s\n", style.prefix, output.Spec, path.Join(output.Dir, output.Template.Path), style.suffix), true
+}
+
+// addGeneratedHeaders inserts a generated by header comment into file outputs
+// of known file types. The header is inserted after a leading shebang or xml
+// declaration line.
+func addGeneratedHeaders(outputs []Output) []Output {
+	res := make([]Output, 0, len(outputs))
+	for _, i := range outputs {
+		if i.Kind != OutputKindFile {
+			res = append(res, i)
+			continue
+		}
+		header, ok := generatedHeader(i)
+		if !ok {
+			res = append(res, i)
+			continue
+		}
+		var b bytes.Buffer
+		data := i.Data
+		if bytes.HasPrefix(data, []byte("#!")) || bytes.HasPrefix(data, []byte("<?xml")) {
+			first, rest, _ := bytes.Cut(data, []byte("\n"))
+			b.Write(first)
+			b.WriteString("\n")
+			data = rest
+		}
+		b.WriteString(header)
+		b.Write(data)
+		i.Data = b.Bytes()
+		res = append(res, i)
+	}
+	return res
+}
+
+// renderOutputs renders component templates, applies output options, and
+// runs component hooks on the outputs. Failed templates are collected into
+// failures if it is not nil.
+func renderOutputs(ctx context.Context, log klog.Logger, cache *Cache, components []Component, opts Opts, failures *failureSet) ([]Output, error) {
+	outputs, err := renderComponents(ctx, log, cache, components, os.Stderr, opts.Jobs, failures)
+	if err != nil {
+		return nil, err
+	}
+	if opts.GeneratedHeaders {
+		outputs = addGeneratedHeaders(outputs)
+	}
+	if err := applyHooks(ctx, klog.NewLevelLogger(log), components, outputs, opts); err != nil {
+		return nil, err
+	}
+	return outputs, nil
+}
@@ -0,0 +1,136 @@
+package component
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"xorkevin.dev/anvil/repofetcher"
+	"xorkevin.dev/anvil/repofetcher/gitfetcher"
+	"xorkevin.dev/anvil/util/kjson"
+	"xorkevin.dev/kerrors"
+	"xorkevin.dev/kfs"
+	"xorkevin.dev/klog"
+)
+
+var (
+	// ErrInvalidReplace is returned when a repo replacement is invalid
+	ErrInvalidReplace errInvalidReplace
+)
+
+type (
+	errInvalidReplace struct{}
+)
+
+func (e errInvalidReplace) Error() string {
+	return "Invalid replace"
+}
+
+type (
+	// OverrideData is the shape of a local override file
+	OverrideData struct {
+		Replace []ReplaceData `json:"replace"`
+	}
+
+	// ReplaceData replaces a git repo, optionally only at a tag, with a local
+	// dir relative to the override file
+	ReplaceData struct {
+		Repo string `json:"repo"`
+		Tag  string `json:"tag"`
+		Dir  string `json:"dir"`
+	}
+)
+
+func parseOverrideFile(name string) (*OverrideData, error) {
+	b, err := os.ReadFile(filepath.FromSlash(name))
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to read override file: %s", name))
+	}
+	var v any
+	// yaml is a superset of json
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, kerrors.WithKind(err, ErrInvalidReplace, fmt.Sprintf("Malformed override file: %s", name))
+	}
+	b, err = json.Marshal(v)
+	if err != nil {
+		return nil, kerrors.WithKind(err, ErrInvalidReplace, fmt.Sprintf("Malformed override file: %s", name))
+	}
+	var data OverrideData
+	if err := kjson.Unmarshal(b, &data); err != nil {
+		return nil, kerrors.WithKind(err, ErrInvalidReplace, fmt.Sprintf("Invalid override file: %s", name))
+	}
+	return &data, nil
+}
+
+// parseReplaceFlag parses a replacement of the form repo[@tag]=dir. A tag is
+// only recognized after the last @ if it contains no : or /, so that ssh repo
+// urls are not mistaken for tags.
+func parseReplaceFlag(s string) (ReplaceData, error) {
+	repo, dir, ok := strings.Cut(s, "=")
+	if !ok {
+		return ReplaceData{}, kerrors.WithKind(nil, ErrInvalidReplace, fmt.Sprintf("Replace must be of the form repo[@tag]=dir: %s", s))
+	}
+	var tag string
+	if n := strings.LastIndex(repo, "@"); n >= 0 && !strings.ContainsAny(repo[n+1:], ":/") {
+		repo, tag = repo[:n], repo[n+1:]
+	}
+	return ReplaceData{
+		Repo: repo,
+		Tag:  tag,
+		Dir:  dir,
+	}, nil
+}
+
+func replacement(r ReplaceData) (repofetcher.Replacement, error) {
+	if r.Repo == "" || r.Dir == "" {
+		return repofetcher.Replacement{}, kerrors.WithKind(nil, ErrInvalidReplace, fmt.Sprintf("Replace for repo %s must have a repo and dir", r.Repo))
+	}
+	return repofetcher.Replacement{
+		Kind:  repoKindGit,
+		Match: gitfetcher.MatchRepo(r.Repo, r.Tag),
+		Fsys:  kfs.NewReadOnlyFS(kfs.DirFS(r.Dir)),
+		Dir:   r.Dir,
+	}, nil
+}
+
+// readReplacements returns repo replacements from the override file followed
+// by replace flags. Flag replacements take precedence. The override file is
+// only read if it is explicitly set.
+func readReplacements(ctx context.Context, log *klog.LevelLogger, opts Opts) ([]repofetcher.Replacement, error) {
+	var replace []ReplaceData
+	for _, i := range opts.Replace {
+		r, err := parseReplaceFlag(i)
+		if err != nil {
+			return nil, err
+		}
+		replace = append(replace, r)
+	}
+	if opts.OverrideFile != "" {
+		data, err := parseOverrideFile(opts.OverrideFile)
+		if err != nil {
+			return nil, err
+		}
+		log.Warn(ctx, "Using local override file", klog.AString("file", opts.OverrideFile))
+		dir := path.Dir(opts.OverrideFile)
+		for _, i := range data.Replace {
+			if i.Dir != "" && !path.IsAbs(i.Dir) {
+				i.Dir = path.Join(dir, i.Dir)
+			}
+			replace = append(replace, i)
+		}
+	}
+	res := make([]repofetcher.Replacement, 0, len(replace))
+	for _, i := range replace {
+		r, err := replacement(i)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
@@ -0,0 +1,190 @@
+package component
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"xorkevin.dev/anvil/repofetcher"
+	"xorkevin.dev/anvil/util/kjson"
+	"xorkevin.dev/kerrors"
+	"xorkevin.dev/klog"
+)
+
+var (
+	// ErrGenerateFailed is returned when components fail to generate in keep
+	// going mode
+	ErrGenerateFailed errGenerateFailed
+)
+
+type (
+	errGenerateFailed struct{}
+)
+
+func (e errGenerateFailed) Error() string {
+	return "Generate failed"
+}
+
+const (
+	// FailureStageParse is a failure parsing a subcomponent
+	FailureStageParse = "parse"
+	// FailureStageRender is a failure rendering a template
+	FailureStageRender = "render"
+)
+
+type (
+	// FailureReportData is the shape of a generation failure report file
+	FailureReportData struct {
+		Failures []Failure `json:"failures"`
+	}
+
+	// Failure is a generation failure. Parse failures are of the failed
+	// subcomponent config, or of the config importing it if the subcomponent
+	// repo could not be resolved. Render failures are of the failed template.
+	Failure struct {
+		Stage    string          `json:"stage"`
+		Repo     string          `json:"repo"`
+		RepoKind string          `json:"repo_kind"`
+		RepoSpec json.RawMessage `json:"repo_spec"`
+		Dir      string          `json:"dir"`
+		Path     string          `json:"path"`
+		Output   string          `json:"output,omitempty"`
+		Error    string          `json:"error"`
+	}
+
+	// failureSet collects generation failures. It is safe for concurrent use.
+	failureSet struct {
+		mu       sync.Mutex
+		failures []Failure
+	}
+)
+
+func newFailureSet() *failureSet {
+	return &failureSet{}
+}
+
+func marshalRepoSpec(spec repofetcher.Spec) (json.RawMessage, error) {
+	b, err := kjson.Marshal(spec.RepoSpec)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(b), nil
+}
+
+func (f *failureSet) add(stage string, spec repofetcher.Spec, dir, p, output string, err error) {
+	repospec, merr := marshalRepoSpec(spec)
+	if merr != nil {
+		repospec = json.RawMessage("null")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, Failure{
+		Stage:    stage,
+		Repo:     spec.String(),
+		RepoKind: spec.Kind,
+		RepoSpec: repospec,
+		Dir:      dir,
+		Path:     p,
+		Output:   output,
+		Error:    err.Error(),
+	})
+}
+
+// merge adds the failures of other
+func (f *failureSet) merge(other *failureSet) {
+	if other == nil {
+		return
+	}
+	other.mu.Lock()
+	failures := slices.Clone(other.failures)
+	other.mu.Unlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, failures...)
+}
+
+func (f *failureSet) len() int {
+	if f == nil {
+		return 0
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.failures)
+}
+
+// sorted returns the failures sorted so that reports do not depend on the
+// order of concurrent jobs
+func (f *failureSet) sorted() []Failure {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	failures := append(make([]Failure, 0, len(f.failures)), f.failures...)
+	slices.SortStableFunc(failures, func(a, b Failure) int {
+		return cmp.Or(
+			cmp.Compare(a.Stage, b.Stage),
+			cmp.Compare(a.Repo, b.Repo),
+			cmp.Compare(a.Dir, b.Dir),
+			cmp.Compare(a.Path, b.Path),
+			cmp.Compare(a.Output, b.Output),
+		)
+	})
+	return failures
+}
+
+func writeFailureReportFile(name string, data FailureReportData) error {
+	b, err := kjson.Marshal(data)
+	if err != nil {
+		return kerrors.WithMsg(err, "Failed to construct failure report")
+	}
+	var f bytes.Buffer
+	if err := json.Indent(&f, b, "", "  "); err != nil {
+		return kerrors.WithMsg(err, "Failed to indent failure report")
+	}
+	if err := os.WriteFile(filepath.FromSlash(name), f.Bytes(), 0o644); err != nil {
+		return kerrors.WithMsg(err, fmt.Sprintf("Failed to write failure report: %s", name))
+	}
+	return nil
+}
+
+// reportFailures logs a summary of collected failures and writes the failure
+// report file if set. An error is returned if any failures were collected.
+func reportFailures(ctx context.Context, log *klog.LevelLogger, failures *failureSet, opts Opts) error {
+	if failures == nil {
+		return nil
+	}
+	sorted := failures.sorted()
+	for _, i := range sorted {
+		log.Error(ctx, "Generation failure",
+			klog.AString("stage", i.Stage),
+			klog.AString("repo", i.Repo),
+			klog.AString("dir", i.Dir),
+			klog.AString("path", i.Path),
+			klog.AString("output", i.Output),
+			klog.AString("err", i.Error),
+		)
+	}
+	if opts.FailureReportFile != "" {
+		if err := writeFailureReportFile(opts.FailureReportFile, FailureReportData{
+			Failures: sorted,
+		}); err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Failed writing failure report: %s", opts.FailureReportFile))
+		}
+		log.Info(ctx, "Wrote failure report", klog.AString("file", opts.FailureReportFile))
+	}
+	if len(sorted) == 0 {
+		return nil
+	}
+	parse := 0
+	for _, i := range sorted {
+		if i.Stage == FailureStageParse {
+			parse++
+		}
+	}
+	log.Warn(ctx, "Generation failures", klog.AInt("parse", parse), klog.AInt("render", len(sorted)-parse))
+	return kerrors.WithKind(nil, ErrGenerateFailed, fmt.Sprintf("Failed generating components: %d failures", len(sorted)))
+}
@@ -0,0 +1,198 @@
+package component
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+
+	"xorkevin.dev/anvil/util/ktrace"
+	"xorkevin.dev/kerrors"
+	"xorkevin.dev/klog"
+)
+
+var (
+	// ErrUnknownSink is returned when the sink kind is not supported
+	ErrUnknownSink errUnknownSink
+)
+
+type (
+	errUnknownSink struct{}
+)
+
+func (e errUnknownSink) Error() string {
+	return "Unknown sink"
+}
+
+const (
+	// SinkKindTar writes outputs as a tar archive
+	SinkKindTar = "tar"
+	// SinkKindZip writes outputs as a zip archive
+	SinkKindZip = "zip"
+	// SinkKindStream writes file outputs as a concatenated stream
+	SinkKindStream = "stream"
+)
+
+type (
+	// Sink receives rendered outputs. Outputs are unique by path and sorted.
+	Sink interface {
+		Write(ctx context.Context, outputs []Output) error
+	}
+
+	// TarSink writes outputs to a tar archive
+	TarSink struct {
+		W io.Writer
+	}
+
+	// ZipSink writes outputs to a zip archive
+	ZipSink struct {
+		W io.Writer
+	}
+
+	// StreamSink writes file outputs to a concatenated stream, with each file
+	// preceded by a yaml document separator and a comment with its path.
+	// Symlink and dir outputs are omitted.
+	StreamSink struct {
+		W io.Writer
+	}
+)
+
+// NewSink creates a [Sink] of a kind writing to w
+func NewSink(kind string, w io.Writer) (Sink, error) {
+	switch kind {
+	case SinkKindTar:
+		return TarSink{W: w}, nil
+	case SinkKindZip:
+		return ZipSink{W: w}, nil
+	case SinkKindStream:
+		return StreamSink{W: w}, nil
+	default:
+		return nil, kerrors.WithKind(nil, ErrUnknownSink, fmt.Sprintf("Unknown sink kind: %s", kind))
+	}
+}
+
+func outputFileMode(output Output) fs.FileMode {
+	if output.ModeSet {
+		return output.Mode
+	}
+	switch output.Kind {
+	case OutputKindDir:
+		return 0o755
+	case OutputKindSymlink:
+		return 0o777
+	default:
+		return defaultFileMode
+	}
+}
+
+// Write implements [Sink]
+func (s TarSink) Write(ctx context.Context, outputs []Output) error {
+	w := tar.NewWriter(s.W)
+	for _, i := range outputs {
+		name := path.Clean(i.Template.Output)
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    int64(outputFileMode(i)),
+			ModTime: time.Unix(0, 0),
+			Format:  tar.FormatPAX,
+		}
+		switch i.Kind {
+		case OutputKindSymlink:
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = string(i.Data)
+		case OutputKindDir:
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name = name + "/"
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(i.Data))
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Failed writing tar header for output %s", name))
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := w.Write(i.Data); err != nil {
+				return kerrors.WithMsg(err, fmt.Sprintf("Failed writing output %s to tar", name))
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		return kerrors.WithMsg(err, "Failed closing tar writer")
+	}
+	return nil
+}
+
+// Write implements [Sink]
+func (s ZipSink) Write(ctx context.Context, outputs []Output) error {
+	w := zip.NewWriter(s.W)
+	for _, i := range outputs {
+		name := path.Clean(i.Template.Output)
+		hdr := &zip.FileHeader{
+			Name:   name,
+			Method: zip.Deflate,
+		}
+		mode := outputFileMode(i)
+		data := i.Data
+		switch i.Kind {
+		case OutputKindSymlink:
+			mode |= fs.ModeSymlink
+		case OutputKindDir:
+			hdr.Name = name + "/"
+			hdr.Method = zip.Store
+			mode |= fs.ModeDir
+			data = nil
+		}
+		hdr.SetMode(mode)
+		f, err := w.CreateHeader(hdr)
+		if err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Failed writing zip header for output %s", name))
+		}
+		if _, err := f.Write(data); err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Failed writing output %s to zip", name))
+		}
+	}
+	if err := w.Close(); err != nil {
+		return kerrors.WithMsg(err, "Failed closing zip writer")
+	}
+	return nil
+}
+
+// Write implements [Sink]
+func (s StreamSink) Write(ctx context.Context, outputs []Output) error {
+	for _, i := range outputs {
+		if i.Kind != OutputKindFile {
+			continue
+		}
+		name := path.Clean(i.Template.Output)
+		if _, err := fmt.Fprintf(s.W, "---\n# anvil output: %s\n", name); err != nil {
+			return kerrors.WithMsg(err, "Failed writing output stream")
+		}
+		if _, err := s.W.Write(i.Data); err != nil {
+			return kerrors.WithMsg(err, "Failed writing output stream")
+		}
+		if len(i.Data) > 0 && i.Data[len(i.Data)-1] != '\n' {
+			if _, err := io.WriteString(s.W, "\n"); err != nil {
+				return kerrors.WithMsg(err, "Failed writing output stream")
+			}
+		}
+	}
+	return nil
+}
+
+func writeOutputsSink(ctx context.Context, log *klog.LevelLogger, sink Sink, outputs []Output, dryrun bool) error {
+	outputs = uniqueOutputs(outputs)
+	if dryrun {
+		log.Info(ctx, "Dry run write outputs to sink", klog.AInt("outputs", len(outputs)))
+		return nil
+	}
+	defer ktrace.Start(ctx, "write", "sink")()
+	if err := sink.Write(ctx, outputs); err != nil {
+		return kerrors.WithMsg(err, "Failed writing outputs to sink")
+	}
+	log.Info(ctx, "Wrote outputs to sink", klog.AInt("outputs", len(outputs)))
+	return nil
+}
@@ -0,0 +1,348 @@
+package component
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"xorkevin.dev/kerrors"
+	"xorkevin.dev/kfs"
+	"xorkevin.dev/klog"
+)
+
+type (
+	// staging is a staging dir next to an output dir, so that it is on the
+	// same filesystem and is never left within the output dir. Outputs are
+	// written to the staging dir, and only moved into the output dir once
+	// every output has been written. Existing entries that are replaced are
+	// moved to a backup dir so that they may be restored on failure.
+	staging struct {
+		output  string
+		root    string
+		newDir  string
+		oldDir  string
+		actions []stagingAction
+	}
+
+	stagingAction struct {
+		target string
+		backup string
+		placed bool
+	}
+)
+
+func newStaging(output string) (*staging, error) {
+	outputDir := filepath.FromSlash(output)
+	if err := os.MkdirAll(outputDir, 0o777); err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed creating output dir: %s", output))
+	}
+	abs, err := filepath.Abs(outputDir)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed resolving output dir: %s", output))
+	}
+	root, err := os.MkdirTemp(filepath.Dir(abs), ".anvil-staging-"+filepath.Base(abs)+"-")
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed creating staging dir next to output dir: %s", output))
+	}
+	s := &staging{
+		output: outputDir,
+		root:   root,
+		newDir: filepath.Join(root, "new"),
+		oldDir: filepath.Join(root, "old"),
+	}
+	for _, i := range []string{s.newDir, s.oldDir} {
+		if err := os.Mkdir(i, 0o777); err != nil {
+			return nil, errors.Join(
+				kerrors.WithMsg(err, fmt.Sprintf("Failed creating staging dir: %s", i)),
+				s.cleanup(),
+			)
+		}
+	}
+	return s, nil
+}
+
+func (s *staging) fsys() fs.FS {
+	return kfs.DirFS(filepath.ToSlash(s.newDir))
+}
+
+func (s *staging) target(p string) string {
+	return filepath.Join(s.output, filepath.FromSlash(p))
+}
+
+func lstatTarget(target string) (fs.FileInfo, error) {
+	info, err := os.Lstat(target)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to stat existing output: %s", target))
+	}
+	return info, nil
+}
+
+// mkdirParents creates the missing parent dirs of an output, recording them so
+// that they may be removed on rollback
+func (s *staging) mkdirParents(p string) error {
+	var missing []string
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		info, err := lstatTarget(s.target(dir))
+		if err != nil {
+			return err
+		}
+		if info != nil {
+			break
+		}
+		missing = append(missing, dir)
+	}
+	for n := len(missing) - 1; n >= 0; n-- {
+		target := s.target(missing[n])
+		if err := os.Mkdir(target, defaultDirMode); err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Failed creating output dir: %s", target))
+		}
+		s.actions = append(s.actions, stagingAction{
+			target: target,
+			placed: true,
+		})
+	}
+	return nil
+}
+
+// backup moves an existing output entry to the backup dir
+func (s *staging) backup(p string) (string, error) {
+	target := s.target(p)
+	backup := filepath.Join(s.oldDir, filepath.FromSlash(p))
+	if err := os.MkdirAll(filepath.Dir(backup), 0o777); err != nil {
+		return "", kerrors.WithMsg(err, fmt.Sprintf("Failed creating backup dir for output: %s", target))
+	}
+	if err := os.Rename(target, backup); err != nil {
+		return "", kerrors.WithMsg(err, fmt.Sprintf("Failed moving existing output to backup dir: %s", target))
+	}
+	return backup, nil
+}
+
+func (s *staging) commitDir(output Output, p string) error {
+	target := s.target(p)
+	info, err := lstatTarget(target)
+	if err != nil {
+		return err
+	}
+	action := stagingAction{
+		target: target,
+		placed: true,
+	}
+	if info != nil {
+		if info.IsDir() {
+			return nil
+		}
+		action.backup, err = s.backup(p)
+		if err != nil {
+			return err
+		}
+	}
+	if err := s.mkdirParents(p); err != nil {
+		return err
+	}
+	if err := os.Mkdir(target, output.Mode); err != nil {
+		s.actions = append(s.actions, stagingAction{
+			target: target,
+			backup: action.backup,
+		})
+		return kerrors.WithMsg(err, fmt.Sprintf("Failed creating dir output: %s", target))
+	}
+	s.actions = append(s.actions, action)
+	return nil
+}
+
+func (s *staging) commitEntry(output Output, p string) error {
+	target := s.target(p)
+	staged := filepath.Join(s.newDir, filepath.FromSlash(p))
+	info, err := lstatTarget(target)
+	if err != nil {
+		return err
+	}
+	action := stagingAction{
+		target: target,
+		placed: true,
+	}
+	if info != nil {
+		if output.Kind == OutputKindFile && !output.ModeSet && info.Mode().IsRegular() {
+			// preserve the mode of an existing file when no mode is specified
+			if err := os.Chmod(staged, info.Mode().Perm()); err != nil {
+				return kerrors.WithMsg(err, fmt.Sprintf("Failed setting mode of staged output: %s", staged))
+			}
+		}
+		action.backup, err = s.backup(p)
+		if err != nil {
+			return err
+		}
+	}
+	if err := s.mkdirParents(p); err != nil {
+		s.actions = append(s.actions, stagingAction{
+			target: target,
+			backup: action.backup,
+		})
+		return err
+	}
+	if err := os.Rename(staged, target); err != nil {
+		s.actions = append(s.actions, stagingAction{
+			target: target,
+			backup: action.backup,
+		})
+		return kerrors.WithMsg(err, fmt.Sprintf("Failed moving staged output into place: %s", target))
+	}
+	s.actions = append(s.actions, action)
+	return nil
+}
+
+func (s *staging) commitPrune(ctx context.Context, log *klog.LevelLogger, p string) error {
+	target := s.target(p)
+	info, err := lstatTarget(target)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		log.Info(ctx, "Stale output already removed", klog.AString("output", p))
+		return nil
+	}
+	if info.IsDir() {
+		entries, err := os.ReadDir(target)
+		if err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Failed reading stale dir output: %s", target))
+		}
+		if len(entries) != 0 {
+			log.Warn(ctx, "Skipping pruning non-empty dir output", klog.AString("output", p))
+			return nil
+		}
+	}
+	backup, err := s.backup(p)
+	if err != nil {
+		return err
+	}
+	s.actions = append(s.actions, stagingAction{
+		target: target,
+		backup: backup,
+	})
+	log.Info(ctx, "Pruned output", klog.AString("output", p))
+	return nil
+}
+
+// commit moves staged outputs into the output dir and prunes stale outputs
+func (s *staging) commit(ctx context.Context, log *klog.LevelLogger, outputs []Output, stale []string) error {
+	outputs = uniqueOutputs(outputs)
+	for _, i := range outputs {
+		if p := path.Clean(i.Template.Output); !fs.ValidPath(p) {
+			return kerrors.WithKind(nil, ErrInvalidOutput, fmt.Sprintf("Invalid output path %s", p))
+		}
+	}
+
+	// dirs are created before other entries, since other outputs may be
+	// staged within them
+	for _, i := range outputs {
+		if i.Kind == OutputKindDir {
+			if err := s.commitDir(i, path.Clean(i.Template.Output)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, i := range outputs {
+		if i.Kind != OutputKindDir {
+			if err := s.commitEntry(i, path.Clean(i.Template.Output)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, i := range stale {
+		if !fs.ValidPath(i) {
+			return kerrors.WithKind(nil, ErrInvalidOutput, fmt.Sprintf("Invalid stale output path %s", i))
+		}
+		if err := s.commitPrune(ctx, log, i); err != nil {
+			return err
+		}
+	}
+	outputfs := kfs.DirFS(filepath.ToSlash(s.output))
+	for _, i := range stale {
+		if err := removeEmptyParents(outputfs, i); err != nil {
+			log.WarnErr(ctx, kerrors.WithMsg(err, "Failed removing empty output dirs"))
+		}
+	}
+	return nil
+}
+
+// rollback undoes every committed action in reverse order
+func (s *staging) rollback() error {
+	var errs []error
+	for n := len(s.actions) - 1; n >= 0; n-- {
+		i := s.actions[n]
+		if i.placed {
+			if err := os.Remove(i.target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, kerrors.WithMsg(err, fmt.Sprintf("Failed removing output during rollback: %s", i.target)))
+				continue
+			}
+		}
+		if i.backup != "" {
+			if err := os.Rename(i.backup, i.target); err != nil {
+				errs = append(errs, kerrors.WithMsg(err, fmt.Sprintf("Failed restoring output during rollback: %s", i.target)))
+			}
+		}
+	}
+	s.actions = nil
+	return errors.Join(errs...)
+}
+
+func (s *staging) cleanup() error {
+	if err := os.RemoveAll(s.root); err != nil {
+		return kerrors.WithMsg(err, fmt.Sprintf("Failed removing staging dir: %s", s.root))
+	}
+	return nil
+}
+
+// writeOutputsStaged writes outputs and prunes stale outputs in an output dir
+// such that either every change is applied or the output dir is left
+// untouched. Outputs identical to existing entries are left untouched.
+func writeOutputsStaged(ctx context.Context, log *klog.LevelLogger, output string, outputs []Output, stale []string) (retErr error) {
+	outputfs := kfs.DirFS(output)
+	stats := &outputStats{}
+	var changed []Output
+	for _, i := range uniqueOutputs(outputs) {
+		change, existing, err := outputChange(outputfs, i)
+		if err != nil {
+			return err
+		}
+		stats.add(change)
+		if change == "" {
+			logUnchangedOutput(ctx, log, i, existing)
+			continue
+		}
+		changed = append(changed, i)
+	}
+	if len(changed) == 0 && len(stale) == 0 {
+		log.Info(ctx, "Outputs up to date", stats.attrs()...)
+		return nil
+	}
+
+	s, err := newStaging(output)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := s.cleanup(); err != nil {
+			retErr = errors.Join(retErr, err)
+		}
+	}()
+	if _, err := writeOutputs(ctx, log, s.fsys(), changed, false); err != nil {
+		return kerrors.WithMsg(err, "Failed writing outputs to staging dir")
+	}
+	if err := s.commit(ctx, log, changed, stale); err != nil {
+		if rerr := s.rollback(); rerr != nil {
+			return errors.Join(err, kerrors.WithMsg(rerr, "Failed rolling back output dir"))
+		}
+		log.Warn(ctx, "Rolled back output dir", klog.AString("output", output))
+		return err
+	}
+	log.Info(ctx, "Wrote outputs", append([]klog.Attr{klog.AString("output", output)}, stats.attrs()...)...)
+	return nil
+}
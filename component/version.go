@@ -0,0 +1,126 @@
+package component
+
+import (
+	"fmt"
+	"strings"
+
+	"xorkevin.dev/kerrors"
+)
+
+// ErrUnsupportedVersion is returned when a config version is not supported
+var ErrUnsupportedVersion errUnsupportedVersion
+
+type (
+	errUnsupportedVersion struct{}
+)
+
+func (e errUnsupportedVersion) Error() string {
+	return "Unsupported config version"
+}
+
+const (
+	// ConfigVersionV1Alpha1 is the initial component config schema. Configs
+	// without a version are v1alpha1.
+	ConfigVersionV1Alpha1 = "xorkevin.dev/anvil/v1alpha1"
+	// ConfigVersionV1Alpha2 adds component params, exports, hooks, named
+	// subcomponents, subcomponent config kinds, and template output kinds and
+	// modes
+	ConfigVersionV1Alpha2 = "xorkevin.dev/anvil/v1alpha2"
+
+	// ConfigVersionLatest is the config schema that configs are migrated to
+	ConfigVersionLatest = ConfigVersionV1Alpha2
+)
+
+type (
+	// configMigration upgrades a config from one schema version to the next
+	configMigration struct {
+		to      string
+		migrate func(config *configData) error
+	}
+)
+
+// configMigrations are the migrations from each supported version. The latest
+// version has no migration.
+var configMigrations = map[string]configMigration{
+	ConfigVersionV1Alpha1: {
+		to:      ConfigVersionV1Alpha2,
+		migrate: migrateV1Alpha1,
+	},
+}
+
+func supportedConfigVersions() string {
+	versions := []string{ConfigVersionV1Alpha1, ConfigVersionV1Alpha2}
+	return strings.Join(versions, ", ")
+}
+
+// v1alpha2Fields returns the fields of a config that were added in v1alpha2
+func v1alpha2Fields(config *configData) []string {
+	var fields []string
+	if config.Params != nil {
+		fields = append(fields, "params")
+	}
+	if config.Exports != nil {
+		fields = append(fields, "exports")
+	}
+	if len(config.Hooks) > 0 {
+		fields = append(fields, "hooks")
+	}
+	for n, i := range config.Components {
+		if i.Name != "" {
+			fields = append(fields, fmt.Sprintf("components[%d].name", n))
+		}
+		if i.ConfigKind != "" {
+			fields = append(fields, fmt.Sprintf("components[%d].config_kind", n))
+		}
+	}
+	for n, i := range config.Templates {
+		if i.OutputKind != "" {
+			fields = append(fields, fmt.Sprintf("templates[%d].output_kind", n))
+		}
+		if i.OutputMode != "" {
+			fields = append(fields, fmt.Sprintf("templates[%d].output_mode", n))
+		}
+		if i.LinkTarget != "" {
+			fields = append(fields, fmt.Sprintf("templates[%d].link_target", n))
+		}
+		if i.Overwrite {
+			fields = append(fields, fmt.Sprintf("templates[%d].overwrite", n))
+		}
+	}
+	return fields
+}
+
+// migrateV1Alpha1 rejects fields added in later versions, and makes the
+// implicit behavior of v1alpha1 explicit. Templates of v1alpha1 configs are
+// always files, and subcomponent configs are always jsonnet regardless of
+// their file extension.
+func migrateV1Alpha1(config *configData) error {
+	if fields := v1alpha2Fields(config); len(fields) > 0 {
+		return kerrors.WithKind(nil, ErrUnsupportedVersion, fmt.Sprintf("Fields %s require config version %s", strings.Join(fields, ", "), ConfigVersionV1Alpha2))
+	}
+	for n := range config.Components {
+		config.Components[n].ConfigKind = configKindJsonnet
+	}
+	for n := range config.Templates {
+		config.Templates[n].OutputKind = OutputKindFile
+	}
+	return nil
+}
+
+// migrateConfig upgrades a config in place to the latest schema version
+func migrateConfig(config *configData) error {
+	if config.Version == "" {
+		config.Version = ConfigVersionV1Alpha1
+	}
+	for config.Version != ConfigVersionLatest {
+		m, ok := configMigrations[config.Version]
+		if !ok {
+			return kerrors.WithKind(nil, ErrUnsupportedVersion, fmt.Sprintf("Unsupported config version %s; supported versions: %s", config.Version, supportedConfigVersions()))
+		}
+		if err := m.migrate(config); err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Failed migrating config from %s to %s", config.Version, m.to))
+		}
+		config.Version = m.to
+	}
+	return nil
+}
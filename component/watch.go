@@ -0,0 +1,320 @@
+package component
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"xorkevin.dev/kerrors"
+	"xorkevin.dev/klog"
+)
+
+const (
+	watchDebounce = 250 * time.Millisecond
+)
+
+type (
+	// watcher regenerates components when local sources change
+	watcher struct {
+		log         *klog.LevelLogger
+		fsw         *fsnotify.Watcher
+		output      string
+		input       string
+		cachedir    string
+		opts        Opts
+		local       string
+		ignore      []string
+		ignoreDirs  []string
+		replaceDirs []string
+		watched     map[string]struct{}
+		cache       *Cache
+		components  []Component
+	}
+)
+
+func absPath(p string) string {
+	abs, err := filepath.Abs(filepath.FromSlash(p))
+	if err != nil {
+		return filepath.Clean(filepath.FromSlash(p))
+	}
+	return abs
+}
+
+// isIgnored returns true for files written by generation itself
+func (w *watcher) isIgnored(name string) bool {
+	name = absPath(name)
+	if slices.Contains(w.ignore, name) {
+		return true
+	}
+	for _, i := range w.ignoreDirs {
+		if name == i || strings.HasPrefix(name, i+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchDirs returns the dir trees of the root, every local component and its
+// templates, and every local replacement dir. Hidden dirs and dirs written by
+// generation are not watched.
+func (w *watcher) watchDirs(ctx context.Context) map[string]struct{} {
+	roots := []string{absPath(w.local)}
+	for _, i := range w.components {
+		if i.Spec.Kind != repoKindLocalDir {
+			continue
+		}
+		roots = append(roots, absPath(path.Join(w.local, i.Dir)))
+		for _, j := range i.Templates {
+			if j.Path == "" {
+				continue
+			}
+			roots = append(roots, absPath(path.Join(w.local, i.Dir, path.Dir(j.Path))))
+		}
+	}
+	roots = append(roots, w.replaceDirs...)
+	dirs := map[string]struct{}{}
+	for _, i := range roots {
+		if _, ok := dirs[i]; ok {
+			continue
+		}
+		if err := filepath.WalkDir(i, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() {
+				return nil
+			}
+			if _, ok := dirs[p]; ok {
+				// already walked from another root
+				return fs.SkipDir
+			}
+			if p != i && (strings.HasPrefix(d.Name(), ".") || w.isIgnored(p)) {
+				return fs.SkipDir
+			}
+			dirs[p] = struct{}{}
+			return nil
+		}); err != nil {
+			w.log.Debug(ctx, "Failed walking watch dir", klog.AString("dir", i), klog.AString("err", err.Error()))
+		}
+	}
+	return dirs
+}
+
+func (w *watcher) updateWatches(ctx context.Context) {
+	dirs := w.watchDirs(ctx)
+	for k := range w.watched {
+		if _, ok := dirs[k]; ok {
+			continue
+		}
+		if err := w.fsw.Remove(k); err != nil {
+			w.log.Debug(ctx, "Failed removing watch", klog.AString("dir", k))
+		}
+		delete(w.watched, k)
+	}
+	for k := range dirs {
+		if _, ok := w.watched[k]; ok {
+			continue
+		}
+		if err := w.fsw.Add(k); err != nil {
+			w.log.WarnErr(ctx, kerrors.WithMsg(err, "Failed watching dir"), klog.AString("dir", k))
+			continue
+		}
+		w.watched[k] = struct{}{}
+	}
+}
+
+// affectedComponents returns the components with only the templates whose
+// files changed. It returns false if a changed file is not a template of a
+// local component, in which case every component must be regenerated.
+func (w *watcher) affectedComponents(changed []string) ([]Component, bool) {
+	localAbs := absPath(w.local)
+	files := map[string]struct{}{}
+	for _, i := range changed {
+		rel, err := filepath.Rel(localAbs, absPath(i))
+		if err != nil {
+			return nil, false
+		}
+		files[filepath.ToSlash(rel)] = struct{}{}
+	}
+
+	// only the last template writing an output determines its content
+	owners := map[string][2]int{}
+	for n, i := range w.components {
+		for m, j := range i.Templates {
+			owners[path.Clean(j.Output)] = [2]int{n, m}
+		}
+	}
+
+	matched := map[string]struct{}{}
+	var affected []Component
+	for n, i := range w.components {
+		if i.Spec.Kind != repoKindLocalDir {
+			continue
+		}
+		var templates []Template
+		for m, j := range i.Templates {
+			if j.Path == "" {
+				continue
+			}
+			p := path.Join(i.Dir, j.Path)
+			if _, ok := files[p]; !ok {
+				continue
+			}
+			matched[p] = struct{}{}
+			if owners[path.Clean(j.Output)] != [2]int{n, m} {
+				continue
+			}
+			templates = append(templates, j)
+		}
+		if len(templates) != 0 {
+			affected = append(affected, Component{
+				Spec:      i.Spec,
+				Dir:       i.Dir,
+				Templates: templates,
+				Hooks:     i.Hooks,
+				node:      i.node,
+			})
+		}
+	}
+	if len(matched) != len(files) {
+		return nil, false
+	}
+	return affected, true
+}
+
+func (w *watcher) generate(ctx context.Context) {
+	cache, components, err := generate(ctx, w.log.Logger, w.output, w.input, w.cachedir, w.opts)
+	if components != nil {
+		w.cache = cache
+		w.components = components
+		w.updateWatches(ctx)
+	}
+	if err != nil {
+		w.log.Err(ctx, kerrors.WithMsg(err, "Failed generating components"))
+		return
+	}
+	w.log.Info(ctx, "Generated components")
+}
+
+func (w *watcher) regenerate(ctx context.Context, changed []string) {
+	if w.cache == nil || w.opts.Check || w.opts.DryRun {
+		w.generate(ctx)
+		return
+	}
+	affected, ok := w.affectedComponents(changed)
+	if !ok {
+		w.log.Info(ctx, "Config sources changed, regenerating all components")
+		w.generate(ctx)
+		return
+	}
+	outputs, err := renderOutputs(ctx, w.log.Logger, w.cache, affected, w.opts, nil)
+	if err != nil {
+		w.log.Err(ctx, kerrors.WithMsg(err, "Failed rendering changed templates"))
+		return
+	}
+	if err := writeOutputsStaged(ctx, w.log, w.output, outputs, nil); err != nil {
+		w.log.Err(ctx, kerrors.WithMsg(err, "Failed writing changed templates"))
+		return
+	}
+	w.log.Info(ctx, "Regenerated changed templates", klog.AInt("templates", len(outputs)))
+}
+
+// Watch generates components and regenerates them whenever local sources
+// change until the context is canceled. Generation errors are logged rather
+// than returned.
+func Watch(ctx context.Context, log klog.Logger, output, input, cachedir string, opts Opts) error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return kerrors.WithMsg(err, "Failed creating file watcher")
+	}
+	defer func() {
+		if err := fsw.Close(); err != nil {
+			klog.NewLevelLogger(log).WarnErr(ctx, kerrors.WithMsg(err, "Failed closing file watcher"))
+		}
+	}()
+
+	local, _ := path.Split(input)
+	w := &watcher{
+		log:        klog.NewLevelLogger(log),
+		fsw:        fsw,
+		output:     output,
+		input:      input,
+		cachedir:   cachedir,
+		opts:       opts,
+		local:      path.Clean(local),
+		ignoreDirs: []string{absPath(output), absPath(cachedir)},
+		watched:    map[string]struct{}{},
+	}
+	for _, i := range []string{opts.ManifestFile, opts.RepoChecksumFile, opts.ProvenanceFile} {
+		if i != "" {
+			w.ignore = append(w.ignore, absPath(i))
+		}
+	}
+
+	replace, err := readReplacements(ctx, w.log, opts)
+	if err != nil {
+		return err
+	}
+	for _, i := range replace {
+		w.replaceDirs = append(w.replaceDirs, absPath(i.Dir))
+	}
+
+	w.generate(ctx)
+	w.updateWatches(ctx)
+	w.log.Info(ctx, "Watching for changes")
+
+	var debounce <-chan time.Time
+	var timer *time.Timer
+	pending := map[string]struct{}{}
+	for {
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return nil
+		case ev, ok := <-fsw.Events:
+			if !ok {
+				return nil
+			}
+			if ev.Op == fsnotify.Chmod || w.isIgnored(ev.Name) {
+				continue
+			}
+			pending[ev.Name] = struct{}{}
+			if timer == nil {
+				timer = time.NewTimer(watchDebounce)
+			} else {
+				// a timer which has fired but has not been received must be
+				// drained so that its stale tick is not received after reset
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(watchDebounce)
+			}
+			debounce = timer.C
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return nil
+			}
+			w.log.WarnErr(ctx, kerrors.WithMsg(err, "File watcher error"))
+		case <-debounce:
+			debounce = nil
+			changed := make([]string, 0, len(pending))
+			for k := range pending {
+				changed = append(changed, k)
+			}
+			slices.Sort(changed)
+			clear(pending)
+			w.log.Info(ctx, "Detected changes", klog.AInt("files", len(changed)))
+			w.regenerate(ctx, changed)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package component
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+	"xorkevin.dev/anvil/repofetcher"
+	"xorkevin.dev/anvil/repofetcher/localdir"
+	"xorkevin.dev/anvil/util/kjson"
+	"xorkevin.dev/kerrors"
+	"xorkevin.dev/klog"
+)
+
+var (
+	// ErrInvalidWorkspace is returned when a workspace file is invalid
+	ErrInvalidWorkspace errInvalidWorkspace
+)
+
+type (
+	errInvalidWorkspace struct{}
+)
+
+func (e errInvalidWorkspace) Error() string {
+	return "Invalid workspace"
+}
+
+type (
+	// WorkspaceData is the shape of a workspace file
+	WorkspaceData struct {
+		Roots []WorkspaceRoot `json:"roots"`
+	}
+
+	// WorkspaceRoot is a root component generated by a workspace. Paths are
+	// relative to the workspace file dir, and inputs must be within it. The
+	// manifest and provenance files of a root are only set by the workspace
+	// file, and are not written if unset.
+	WorkspaceRoot struct {
+		Input      string         `json:"input"`
+		Output     string         `json:"output"`
+		Args       map[string]any `json:"args"`
+		ArgsFiles  []string       `json:"args_files"`
+		Manifest   string         `json:"manifest"`
+		Provenance string         `json:"provenance"`
+	}
+)
+
+// ParseWorkspaceFile reads a json or yaml workspace file
+func ParseWorkspaceFile(name string) (*WorkspaceData, error) {
+	b, err := os.ReadFile(filepath.FromSlash(name))
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to read workspace file: %s", name))
+	}
+	var v any
+	switch path.Ext(name) {
+	case ".json":
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, kerrors.WithKind(err, ErrInvalidWorkspace, fmt.Sprintf("Malformed workspace file: %s", name))
+		}
+	default:
+		// yaml is a superset of json
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			return nil, kerrors.WithKind(err, ErrInvalidWorkspace, fmt.Sprintf("Malformed workspace file: %s", name))
+		}
+	}
+	// round trip through json so that yaml and json files decode identically
+	b, err = json.Marshal(v)
+	if err != nil {
+		return nil, kerrors.WithKind(err, ErrInvalidWorkspace, fmt.Sprintf("Malformed workspace file: %s", name))
+	}
+	var data WorkspaceData
+	if err := kjson.Unmarshal(b, &data); err != nil {
+		return nil, kerrors.WithKind(err, ErrInvalidWorkspace, fmt.Sprintf("Invalid workspace file: %s", name))
+	}
+	if len(data.Roots) == 0 {
+		return nil, kerrors.WithKind(nil, ErrInvalidWorkspace, fmt.Sprintf("Workspace file has no roots: %s", name))
+	}
+	for n, i := range data.Roots {
+		if i.Input == "" || !fs.ValidPath(path.Clean(i.Input)) {
+			return nil, kerrors.WithKind(nil, ErrInvalidWorkspace, fmt.Sprintf("Workspace root %d input must be a path within the workspace dir: %s", n, i.Input))
+		}
+		if i.Output == "" {
+			return nil, kerrors.WithKind(nil, ErrInvalidWorkspace, fmt.Sprintf("Workspace root %d is missing an output", n))
+		}
+	}
+	return &data, nil
+}
+
+func workspacePath(dir, p string) string {
+	if p == "" || path.IsAbs(p) {
+		return p
+	}
+	return path.Join(dir, p)
+}
+
+// workspaceRootArgs returns the args of a workspace root. Root args files are
+// merged in order followed by root args, and then args from opts are applied
+// to every root.
+func workspaceRootArgs(dir string, root WorkspaceRoot, opts Opts) (map[string]any, error) {
+	files := make([]string, 0, len(root.ArgsFiles))
+	for _, i := range root.ArgsFiles {
+		files = append(files, workspacePath(dir, i))
+	}
+	return MergeRootArgs(
+		RootArgs{
+			Files: files,
+			Args:  root.Args,
+		},
+		RootArgs{
+			Files: opts.ArgsFiles,
+			Sets:  opts.Args,
+		},
+	)
+}
+
+// GenerateWorkspace generates every root of a workspace file in order. Roots
+// share a repo and config engine cache, and a single repo checksum file is
+// written for all roots. The manifest and provenance files of opts are
+// replaced by those of each root.
+func GenerateWorkspace(ctx context.Context, log klog.Logger, workspace, cachedir string, opts Opts) error {
+	l := klog.NewLevelLogger(log)
+
+	if opts.Sink != nil {
+		return kerrors.WithKind(nil, ErrInvalidWorkspace, "Workspaces may only be generated to output dirs")
+	}
+
+	data, err := ParseWorkspaceFile(workspace)
+	if err != nil {
+		return err
+	}
+	dir := path.Dir(workspace)
+
+	sums, err := readRepoChecksums(ctx, l, opts)
+	if err != nil {
+		return err
+	}
+
+	cache, err := newGenerateCache(ctx, log, dir, cachedir, sums, opts)
+	if err != nil {
+		return err
+	}
+
+	var failures *failureSet
+	if opts.KeepGoing {
+		failures = newFailureSet()
+	}
+
+	for n, i := range data.Roots {
+		rctx := klog.CtxWithAttrs(ctx, klog.AString("root", i.Input))
+		args, err := workspaceRootArgs(dir, i, opts)
+		if err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Invalid args for workspace root %d %s", n, i.Input))
+		}
+		// each root collects its own failures so that failures of one root do
+		// not affect pruning the outputs of another
+		var rfailures *failureSet
+		if opts.KeepGoing {
+			rfailures = newFailureSet()
+		}
+		components, err := parseComponents(
+			rctx,
+			cache,
+			repofetcher.Spec{Kind: repoKindLocalDir, RepoSpec: localdir.RepoSpec{}},
+			path.Clean(i.Input),
+			args,
+			os.Stderr,
+			opts.Jobs,
+			rfailures,
+		)
+		if err != nil {
+			failures.merge(rfailures)
+			return errors.Join(kerrors.WithMsg(err, fmt.Sprintf("Failed parsing workspace root %d %s", n, i.Input)), reportFailures(ctx, l, failures, opts))
+		}
+		ropts := opts
+		ropts.ManifestFile = workspacePath(dir, i.Manifest)
+		ropts.ProvenanceFile = workspacePath(dir, i.Provenance)
+		if err := writeComponents(rctx, l, workspacePath(dir, i.Output), cache, components, ropts, rfailures); err != nil {
+			failures.merge(rfailures)
+			return errors.Join(kerrors.WithMsg(err, fmt.Sprintf("Failed generating workspace root %d %s", n, i.Input)), reportFailures(ctx, l, failures, opts))
+		}
+		failures.merge(rfailures)
+		l.Info(rctx, "Generated workspace root")
+	}
+
+	if failures.len() == 0 {
+		// repos of failed subcomponents may be missing from the cache
+		if err := writeRepoChecksums(ctx, l, cache, opts); err != nil {
+			return err
+		}
+	}
+	return reportFailures(ctx, l, failures, opts)
+}
@@ -35,6 +35,13 @@ type (
 		Exec(ctx context.Context, name string, args map[string]any, stderr io.Writer) (io.ReadCloser, error)
 	}
 
+	// FieldEngine is a [ConfEngine] that can evaluate a single top level field
+	// of a config. It returns null if the field is not present.
+	FieldEngine interface {
+		ConfEngine
+		ExecField(ctx context.Context, name string, field string, args map[string]any, stderr io.Writer) (io.ReadCloser, error)
+	}
+
 	// Builder builds a [ConfEngine]
 	Builder interface {
 		Build(fsys fs.FS) (ConfEngine, error)
@@ -47,6 +54,22 @@ type (
 	Map map[string]Builder
 )
 
+type (
+	ctxKeyExports struct{}
+)
+
+// WithExports returns a context holding the exported values of subcomponents
+// by name, to be made available to configs
+func WithExports(ctx context.Context, exports map[string]any) context.Context {
+	return context.WithValue(ctx, ctxKeyExports{}, exports)
+}
+
+// GetExports returns the exported values of subcomponents from a context
+func GetExports(ctx context.Context) map[string]any {
+	v, _ := ctx.Value(ctxKeyExports{}).(map[string]any)
+	return v
+}
+
 func (f BuilderFunc) Build(fsys fs.FS) (ConfEngine, error) {
 	return f(fsys)
 }
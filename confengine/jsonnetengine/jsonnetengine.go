@@ -82,7 +82,8 @@ func (b Builder) Build(fsys fs.FS) (confengine.ConfEngine, error) {
 
 type (
 	confArgs struct {
-		args map[string]any
+		args    map[string]any
+		exports map[string]any
 	}
 )
 
@@ -93,10 +94,24 @@ func (a confArgs) getargs(args []any) (any, error) {
 	return a.args, nil
 }
 
-func (e *Engine) buildVM(args map[string]any, stderr io.Writer) *jsonnet.VM {
+func (a confArgs) getexports(args []any) (any, error) {
+	if len(args) != 0 {
+		return nil, kerrors.WithKind(nil, confengine.ErrInvalidArgs, "getexports does not take arguments")
+	}
+	return a.exports, nil
+}
+
+func (e *Engine) buildVM(args map[string]any, exports map[string]any, stderr io.Writer) *jsonnet.VM {
 	if args == nil {
 		args = map[string]any{}
 	}
+	if exports == nil {
+		exports = map[string]any{}
+	}
+	cargs := confArgs{
+		args:    args,
+		exports: exports,
+	}
 	if stderr == nil {
 		stderr = io.Discard
 	}
@@ -111,7 +126,12 @@ func (e *Engine) buildVM(args map[string]any, stderr io.Writer) *jsonnet.VM {
 	for _, v := range append([]NativeFunc{
 		{
 			Name:   "getargs",
-			Fn:     confArgs{args: args}.getargs,
+			Fn:     cargs.getargs,
+			Params: []string{},
+		},
+		{
+			Name:   "getexports",
+			Fn:     cargs.getexports,
 			Params: []string{},
 		},
 		{
@@ -250,7 +270,7 @@ func (e *Engine) buildVM(args map[string]any, stderr io.Writer) *jsonnet.VM {
 
 // Exec implements [confengine.ConfEngine] and generates config using jsonnet
 func (e *Engine) Exec(ctx context.Context, name string, args map[string]any, stderr io.Writer) (io.ReadCloser, error) {
-	vm := e.buildVM(args, stderr)
+	vm := e.buildVM(args, confengine.GetExports(ctx), stderr)
 	b, err := vm.EvaluateFile(name)
 	if err != nil {
 		return nil, kerrors.WithMsg(err, "Failed to execute jsonnet")
@@ -258,6 +278,28 @@ func (e *Engine) Exec(ctx context.Context, name string, args map[string]any, std
 	return io.NopCloser(strings.NewReader(b)), nil
 }
 
+// ExecField implements [confengine.FieldEngine] and evaluates a single field
+// of a jsonnet config
+func (e *Engine) ExecField(ctx context.Context, name string, field string, args map[string]any, stderr io.Writer) (io.ReadCloser, error) {
+	// the snippet is evaluated as if it were the file itself, so the file is
+	// imported relative to its own dir
+	namestr, err := json.Marshal(path.Base(name))
+	if err != nil {
+		return nil, kerrors.WithMsg(err, "Invalid jsonnet file name")
+	}
+	fieldstr, err := json.Marshal(field)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, "Invalid jsonnet field name")
+	}
+	vm := e.buildVM(args, confengine.GetExports(ctx), stderr)
+	// jsonnet objects are lazily evaluated, so only the field is evaluated
+	b, err := vm.EvaluateAnonymousSnippet(name, fmt.Sprintf("local c = import %s; if std.objectHasAll(c, %s) then c[%s] else null", namestr, fieldstr, fieldstr))
+	if err != nil {
+		return nil, kerrors.WithMsg(err, "Failed to execute jsonnet")
+	}
+	return io.NopCloser(strings.NewReader(b)), nil
+}
+
 type (
 	fsImporter struct {
 		root          fs.FS
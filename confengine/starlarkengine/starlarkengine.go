@@ -0,0 +1,127 @@
+package starlarkengine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+
+	starjson "go.starlark.net/lib/json"
+	starmath "go.starlark.net/lib/math"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"xorkevin.dev/anvil/confengine"
+	"xorkevin.dev/anvil/util/starlarkmod"
+	"xorkevin.dev/kerrors"
+)
+
+// ErrImportCycle is returned when module dependencies form a cycle
+var ErrImportCycle = starlarkmod.ErrImportCycle
+
+type (
+	// Engine is a starlark config engine. Configs are modules with a global
+	// main function which is called with the args and returns the config.
+	// Unlike the starlark workflow engine, configs may only load other modules
+	// and the pure json and math libs. Configs are always fully evaluated, and
+	// do not implement [confengine.FieldEngine].
+	Engine struct {
+		fsys    fs.FS
+		libname string
+	}
+
+	// Opt are starlark engine constructor options
+	Opt = func(e *Engine)
+)
+
+// New creates a new [*Engine] which is rooted at a particular file system
+func New(fsys fs.FS, opts ...Opt) *Engine {
+	eng := &Engine{
+		fsys:    fsys,
+		libname: "anvil:std",
+	}
+	for _, i := range opts {
+		i(eng)
+	}
+	return eng
+}
+
+func OptLibName(name string) Opt {
+	return func(e *Engine) {
+		e.libname = name
+	}
+}
+
+type (
+	Builder []Opt
+)
+
+func (b Builder) Build(fsys fs.FS) (confengine.ConfEngine, error) {
+	return New(fsys, b...), nil
+}
+
+func (e *Engine) createModLoader(stderr io.Writer) *starlarkmod.Loader {
+	return starlarkmod.NewLoader(
+		e.fsys,
+		stderr,
+		map[string]starlark.StringDict{
+			e.libname + ":json": starjson.Module.Members,
+			e.libname + ":math": starmath.Module.Members,
+		},
+		func(module string) starlark.StringDict {
+			return starlark.StringDict{
+				"struct": starlark.NewBuiltin("struct", starlarkstruct.Make),
+			}
+		},
+	)
+}
+
+// Exec implements [confengine.ConfEngine] and calls the main function of a
+// starlark module with args, returning its result as json
+func (e *Engine) Exec(ctx context.Context, name string, args map[string]any, stderr io.Writer) (io.ReadCloser, error) {
+	if args == nil {
+		args = map[string]any{}
+	}
+	if stderr == nil {
+		stderr = io.Discard
+	}
+	argsjson, err := json.Marshal(args)
+	if err != nil {
+		return nil, kerrors.WithKind(err, confengine.ErrInvalidArgs, "Failed to marshal args")
+	}
+	ml := e.createModLoader(stderr)
+	vals, err := ml.Load(ctx, "", name)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to load module %s", name))
+	}
+	f, ok := vals["main"]
+	if !ok {
+		return nil, kerrors.WithMsg(nil, fmt.Sprintf("Global main not defined for module %s", name))
+	}
+	if _, ok := f.(starlark.Callable); !ok {
+		return nil, kerrors.WithMsg(nil, fmt.Sprintf("Global main in module %s is not callable", name))
+	}
+	thread := &starlark.Thread{
+		Name:  name + ".main",
+		Print: starlarkmod.Print(stderr),
+	}
+	thread.SetLocal("ctx", ctx)
+	sargs, err := starlark.Call(thread, starjson.Module.Members["decode"], starlark.Tuple{starlark.String(argsjson)}, nil)
+	if err != nil {
+		return nil, kerrors.WithKind(err, confengine.ErrInvalidArgs, "Failed converting args to starlark values")
+	}
+	sv, err := starlark.Call(thread, f, starlark.Tuple{sargs}, nil)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed executing main function in module %s", name))
+	}
+	out, err := starlark.Call(thread, starjson.Module.Members["encode"], starlark.Tuple{sv}, nil)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed encoding result of module %s as json", name))
+	}
+	s, ok := starlark.AsString(out)
+	if !ok {
+		return nil, kerrors.WithMsg(nil, fmt.Sprintf("Failed encoding result of module %s as json", name))
+	}
+	return io.NopCloser(bytes.NewReader([]byte(s))), nil
+}
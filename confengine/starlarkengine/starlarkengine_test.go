@@ -0,0 +1,124 @@
+package starlarkengine
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	var filemode fs.FileMode = 0o644
+
+	for _, tc := range []struct {
+		Name     string
+		Opts     []Opt
+		Fsys     fs.FS
+		File     string
+		Args     map[string]any
+		Expected string
+		Stderr   string
+		ErrIs    error
+	}{
+		{
+			Name: "executes starlark",
+			Fsys: fstest.MapFS{
+				"comp/main.star": &fstest.MapFile{
+					Data: []byte(`
+load("anvil:std:json", "decode")
+load("lib.star", "template")
+
+def main(args):
+  print("hello")
+  return {
+    "version": "xorkevin.dev/anvil/v1alpha2",
+    "templates": [template(args["name"])],
+    "exports": decode('{"a": 1}'),
+  }
+`),
+					Mode:    filemode,
+					ModTime: now,
+				},
+				"comp/lib.star": &fstest.MapFile{
+					Data: []byte(`
+def template(name):
+  return {"kind": "staticfile", "path": name, "output": name}
+`),
+					Mode:    filemode,
+					ModTime: now,
+				},
+			},
+			File:     "comp/main.star",
+			Args:     map[string]any{"name": "a.txt"},
+			Expected: `{"exports":{"a":1},"templates":[{"kind":"staticfile","output":"a.txt","path":"a.txt"}],"version":"xorkevin.dev/anvil/v1alpha2"}`,
+			Stderr:   "hello\n",
+		},
+		{
+			Name: "uses lib name",
+			Opts: []Opt{OptLibName("custom:std")},
+			Fsys: fstest.MapFS{
+				"main.star": &fstest.MapFile{
+					Data: []byte(`
+load("custom:std:math", "floor")
+def main(args):
+  return {"a": floor(1.5)}
+`),
+					Mode:    filemode,
+					ModTime: now,
+				},
+			},
+			File:     "main.star",
+			Expected: `{"a":1}`,
+		},
+		{
+			Name: "detects import cycles",
+			Fsys: fstest.MapFS{
+				"main.star": &fstest.MapFile{
+					Data: []byte(`
+load("other.star", "a")
+def main(args):
+  return a
+`),
+					Mode:    filemode,
+					ModTime: now,
+				},
+				"other.star": &fstest.MapFile{
+					Data:    []byte(`load("main.star", "main")` + "\na = 1\n"),
+					Mode:    filemode,
+					ModTime: now,
+				},
+			},
+			File:  "main.star",
+			ErrIs: ErrImportCycle,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			assert := require.New(t)
+
+			eng, err := Builder(tc.Opts).Build(tc.Fsys)
+			assert.NoError(err)
+			var stderr bytes.Buffer
+			out, err := eng.Exec(context.Background(), tc.File, tc.Args, &stderr)
+			if tc.ErrIs != nil {
+				assert.ErrorIs(err, tc.ErrIs)
+				return
+			}
+			assert.NoError(err)
+			var b bytes.Buffer
+			_, err = io.Copy(&b, out)
+			assert.NoError(err)
+			assert.NoError(out.Close())
+			assert.Equal(tc.Expected, b.String())
+			assert.Equal(tc.Stderr, stderr.String())
+		})
+	}
+}
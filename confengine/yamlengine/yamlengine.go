@@ -0,0 +1,82 @@
+package yamlengine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"gopkg.in/yaml.v3"
+	"xorkevin.dev/anvil/confengine"
+	"xorkevin.dev/kerrors"
+)
+
+type (
+	// Engine is a yaml and json data config engine. Configs are static data,
+	// so args are ignored.
+	Engine struct {
+		fsys fs.FS
+	}
+)
+
+// New creates a new [*Engine] which is rooted at a particular file system
+func New(fsys fs.FS) *Engine {
+	return &Engine{
+		fsys: fsys,
+	}
+}
+
+type (
+	Builder struct{}
+)
+
+func (b Builder) Build(fsys fs.FS) (confengine.ConfEngine, error) {
+	return New(fsys), nil
+}
+
+func (e *Engine) readFile(name string) (any, error) {
+	b, err := fs.ReadFile(e.fsys, name)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to read file: %s", name))
+	}
+	var v any
+	// yaml is a superset of json
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to parse file: %s", name))
+	}
+	return v, nil
+}
+
+func marshalOutput(name string, v any) (io.ReadCloser, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to marshal file to json: %s", name))
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+// Exec implements [confengine.ConfEngine] and converts yaml or json files to
+// json
+func (e *Engine) Exec(ctx context.Context, name string, args map[string]any, stderr io.Writer) (io.ReadCloser, error) {
+	v, err := e.readFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return marshalOutput(name, v)
+}
+
+// ExecField implements [confengine.FieldEngine] and converts a top level field
+// of a yaml or json file to json
+func (e *Engine) ExecField(ctx context.Context, name string, field string, args map[string]any, stderr io.Writer) (io.ReadCloser, error) {
+	v, err := e.readFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var fv any
+	if m, ok := v.(map[string]any); ok {
+		fv = m[field]
+	}
+	return marshalOutput(name, fv)
+}
@@ -0,0 +1,88 @@
+package yamlengine
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	var filemode fs.FileMode = 0o644
+
+	fsys := fstest.MapFS{
+		"foo.yaml": &fstest.MapFile{
+			Data: []byte(`
+version: v1
+templates:
+  - path: a.txt
+    output: b.txt
+`),
+			Mode:    filemode,
+			ModTime: now,
+		},
+		"bar.json": &fstest.MapFile{
+			Data:    []byte(`{"version": "v1", "exports": {"a": 1}}`),
+			Mode:    filemode,
+			ModTime: now,
+		},
+	}
+
+	for _, tc := range []struct {
+		Name     string
+		File     string
+		Field    string
+		Expected string
+	}{
+		{
+			Name:     "converts yaml to json",
+			File:     "foo.yaml",
+			Expected: `{"templates":[{"output":"b.txt","path":"a.txt"}],"version":"v1"}`,
+		},
+		{
+			Name:     "converts json",
+			File:     "bar.json",
+			Expected: `{"exports":{"a":1},"version":"v1"}`,
+		},
+		{
+			Name:     "returns a field",
+			File:     "bar.json",
+			Field:    "exports",
+			Expected: `{"a":1}`,
+		},
+		{
+			Name:     "returns null for a missing field",
+			File:     "foo.yaml",
+			Field:    "components",
+			Expected: `null`,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			assert := require.New(t)
+
+			eng := New(fsys)
+			var out io.ReadCloser
+			var err error
+			if tc.Field == "" {
+				out, err = eng.Exec(context.Background(), tc.File, nil, nil)
+			} else {
+				out, err = eng.ExecField(context.Background(), tc.File, tc.Field, nil, nil)
+			}
+			assert.NoError(err)
+			var b bytes.Buffer
+			_, err = io.Copy(&b, out)
+			assert.NoError(err)
+			assert.NoError(out.Close())
+			assert.Equal(tc.Expected, b.String())
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package gitfetcher
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -44,6 +45,11 @@ type (
 		GitClone(ctx context.Context, repodir string, repospec RepoSpec) error
 	}
 
+	// GitRefResolver is a [GitCmd] that resolves remote branches to commits
+	GitRefResolver interface {
+		GitResolveBranch(ctx context.Context, repo string, branch string) (string, error)
+	}
+
 	// Opt is a constructor option
 	Opt = func(*Fetcher)
 )
@@ -89,6 +95,18 @@ func OptForceFetch(v bool) Opt {
 	}
 }
 
+// MatchRepo returns a function matching git repo specs of a repo, and of a
+// tag if tag is not empty
+func MatchRepo(repo, tag string) func(repospec repofetcher.RepoSpec) bool {
+	return func(repospec repofetcher.RepoSpec) bool {
+		o, ok := repospec.(RepoSpec)
+		if !ok {
+			return false
+		}
+		return o.Repo == repo && (tag == "" || o.Tag == tag)
+	}
+}
+
 func (o RepoSpec) Key() (string, error) {
 	var s strings.Builder
 	if o.Repo == "" {
@@ -175,6 +193,53 @@ func (f *Fetcher) Fetch(ctx context.Context, spec repofetcher.RepoSpec) (fs.FS,
 	return kfs.NewReadOnlyFS(kfs.NewMaskFS(rfsys, f.maskGitDir)), nil
 }
 
+func isFloating(o RepoSpec) bool {
+	return o.Tag == "" && o.Commit == "" && o.Branch != ""
+}
+
+// LockKey implements [repofetcher.Locker] for repo specs with only a branch
+func (f *Fetcher) LockKey(spec repofetcher.RepoSpec) (string, bool) {
+	repospec, ok := spec.(RepoSpec)
+	if !ok || !isFloating(repospec) {
+		return "", false
+	}
+	return url.QueryEscape(repospec.Repo) + "@" + url.QueryEscape(repospec.Branch), true
+}
+
+// Lock implements [repofetcher.Locker] and resolves the branch of a repo spec
+// to its current commit
+func (f *Fetcher) Lock(ctx context.Context, spec repofetcher.RepoSpec) (string, error) {
+	repospec, ok := spec.(RepoSpec)
+	if !ok {
+		return "", kerrors.WithKind(nil, repofetcher.ErrInvalidRepoSpec, "Invalid spec type")
+	}
+	if repospec.Repo == "" {
+		return "", kerrors.WithKind(nil, repofetcher.ErrInvalidRepoSpec, "No repo specified")
+	}
+	if f.noNetwork {
+		return "", kerrors.WithKind(nil, repofetcher.ErrNetworkRequired, fmt.Sprintf("Unlocked branch %s for repo %s", repospec.Branch, repospec.Repo))
+	}
+	r, ok := f.gitCmd.(GitRefResolver)
+	if !ok {
+		return "", kerrors.WithMsg(nil, "Git cmd may not resolve branches")
+	}
+	commit, err := r.GitResolveBranch(ctx, repospec.Repo, repospec.Branch)
+	if err != nil {
+		return "", err
+	}
+	return commit, nil
+}
+
+// ApplyLock implements [repofetcher.Locker] and sets the commit of a repo spec
+func (f *Fetcher) ApplyLock(spec repofetcher.RepoSpec, lock string) (repofetcher.RepoSpec, error) {
+	repospec, ok := spec.(RepoSpec)
+	if !ok {
+		return nil, kerrors.WithKind(nil, repofetcher.ErrInvalidRepoSpec, "Invalid spec type")
+	}
+	repospec.Commit = lock
+	return repospec, nil
+}
+
 func (f *Fetcher) maskGitDir(p string) (bool, error) {
 	return p != f.gitDir && !strings.HasPrefix(p, f.gitDirPrefix), nil
 }
@@ -257,6 +322,25 @@ func (g *GitBin) GitClone(ctx context.Context, repodir string, repospec RepoSpec
 	return nil
 }
 
+// GitResolveBranch implements [GitRefResolver] with git ls-remote
+func (g *GitBin) GitResolveBranch(ctx context.Context, repo string, branch string) (string, error) {
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, g.bin, "ls-remote", "--exit-code", repo, "refs/heads/"+branch)
+	cmd.Env = os.Environ()
+	cmd.Stdout = &stdout
+	if !g.quiet {
+		cmd.Stderr = g.Stderr
+	}
+	if err := cmd.Run(); err != nil {
+		return "", kerrors.WithMsg(err, fmt.Sprintf("Failed to resolve branch %s for repo %s", branch, repo))
+	}
+	commit, _, _ := strings.Cut(strings.TrimSpace(stdout.String()), "\t")
+	if commit == "" {
+		return "", kerrors.WithMsg(nil, fmt.Sprintf("Branch %s not found for repo %s", branch, repo))
+	}
+	return commit, nil
+}
+
 func (g *GitBin) runCmd(cmd *exec.Cmd, dir string) error {
 	cmd.Dir = dir
 	cmd.Env = os.Environ()
@@ -63,6 +63,81 @@ func (m *mockGitCmd) GitClone(ctx context.Context, repodir string, repospec Repo
 	return nil
 }
 
+func (m *mockGitCmd) GitResolveBranch(ctx context.Context, repo string, branch string) (string, error) {
+	if repo != m.repo {
+		return "", kerrors.WithMsg(nil, "Unknown repo")
+	}
+	return "resolved-" + branch, nil
+}
+
+func TestLock(t *testing.T) {
+	t.Parallel()
+
+	repo := "git@example.com:example/repo.git"
+	lockkey := "git:git%40example.com%3Aexample%2Frepo.git@main"
+
+	for _, tc := range []struct {
+		Name     string
+		Locks    map[string]string
+		Update   bool
+		Expected string
+	}{
+		{
+			Name:     "resolves unlocked branches",
+			Expected: "resolved-main",
+		},
+		{
+			Name:     "uses existing locks",
+			Locks:    map[string]string{lockkey: "existing"},
+			Expected: "existing",
+		},
+		{
+			Name:     "updates existing locks",
+			Locks:    map[string]string{lockkey: "existing"},
+			Update:   true,
+			Expected: "resolved-main",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			fetcher := New(nil, klog.Discard{}, OptGitCmd(&mockGitCmd{repo: repo}))
+			cache := repofetcher.NewCache(repofetcher.Map{"git": fetcher}, nil, nil, repofetcher.OptLocks(tc.Locks, tc.Update))
+
+			spec, err := cache.Parse("git", []byte(`{"repo": "git@example.com:example/repo.git", "branch": "main"}`))
+			assert.NoError(err)
+			_, err = spec.RepoSpec.Key()
+			assert.ErrorIs(err, repofetcher.ErrInvalidRepoSpec)
+
+			locked, err := cache.Lock(context.Background(), spec)
+			assert.NoError(err)
+			assert.Equal(RepoSpec{Repo: repo, Branch: "main", Commit: tc.Expected}, locked.RepoSpec)
+			assert.Equal([]repofetcher.RepoLock{{Key: lockkey, Lock: tc.Expected}}, cache.Locks())
+
+			tagged, err := cache.Parse("git", []byte(`{"repo": "git@example.com:example/repo.git", "tag": "v1"}`))
+			assert.NoError(err)
+			locked, err = cache.Lock(context.Background(), tagged)
+			assert.NoError(err)
+			assert.Equal(tagged, locked)
+		})
+	}
+
+	t.Run("requires network for unlocked branches", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		fetcher := New(nil, klog.Discard{}, OptGitCmd(&mockGitCmd{repo: repo}), OptNoNetwork(true))
+		cache := repofetcher.NewCache(repofetcher.Map{"git": fetcher}, nil, nil)
+		spec, err := cache.Parse("git", []byte(`{"repo": "git@example.com:example/repo.git", "branch": "main"}`))
+		assert.NoError(err)
+		_, err = cache.Lock(context.Background(), spec)
+		assert.ErrorIs(err, repofetcher.ErrNetworkRequired)
+	})
+}
+
 func TestFetcher(t *testing.T) {
 	t.Parallel()
 
@@ -2,6 +2,7 @@ package repofetcher
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -10,11 +11,14 @@ import (
 	"path"
 	"slices"
 	"strings"
+	"sync"
 
+	"xorkevin.dev/anvil/util/ktrace"
 	"xorkevin.dev/hunter2/h2streamhash"
 	"xorkevin.dev/hunter2/h2streamhash/blake2bstream"
 	"xorkevin.dev/kerrors"
 	"xorkevin.dev/kfs"
+	"xorkevin.dev/klog"
 )
 
 var (
@@ -26,6 +30,9 @@ var (
 	ErrInvalidCache errInvalidCache
 	// ErrNetworkRequired is returned when the network is required to complete the operation
 	ErrNetworkRequired errNetworkRequired
+	// ErrMissingChecksum is returned when a repo has no recorded checksum in
+	// strict mode
+	ErrMissingChecksum errMissingChecksum
 )
 
 type (
@@ -33,6 +40,7 @@ type (
 	errInvalidRepoSpec struct{}
 	errInvalidCache    struct{}
 	errNetworkRequired struct{}
+	errMissingChecksum struct{}
 )
 
 func (e errUnknownKind) Error() string {
@@ -51,6 +59,10 @@ func (e errNetworkRequired) Error() string {
 	return "Network required"
 }
 
+func (e errMissingChecksum) Error() string {
+	return "Missing checksum"
+}
+
 type (
 	// RepoSpec are repo specific options
 	RepoSpec interface {
@@ -69,6 +81,19 @@ type (
 		Fetch(ctx context.Context, repospec RepoSpec) (fs.FS, error)
 	}
 
+	// Locker is a [RepoFetcher] whose repo specs may float, such as those
+	// following a branch. Floating repo specs must be locked to a fixed spec
+	// before they are fetched.
+	Locker interface {
+		// LockKey returns the key of a floating repo spec, or false if the repo
+		// spec is fixed
+		LockKey(repospec RepoSpec) (string, bool)
+		// Lock resolves a floating repo spec to a lock
+		Lock(ctx context.Context, repospec RepoSpec) (string, error)
+		// ApplyLock returns the fixed repo spec of a floating repo spec and lock
+		ApplyLock(repospec RepoSpec, lock string) (RepoSpec, error)
+	}
+
 	// Map is a map from kinds to repo fetchers
 	Map map[string]RepoFetcher
 )
@@ -94,6 +119,15 @@ func (m Map) Parse(kind string, repobytes []byte) (Spec, error) {
 	if err != nil {
 		return Spec{}, kerrors.WithMsg(err, fmt.Sprintf("Failed to build %s repo spec", kind))
 	}
+	if l, ok := f.(Locker); ok {
+		if _, ok := l.LockKey(repospec); ok {
+			// floating repo specs are validated when locked
+			return Spec{
+				Kind:     kind,
+				RepoSpec: repospec,
+			}, nil
+		}
+	}
 	if _, err := repospec.Key(); err != nil {
 		return Spec{}, kerrors.WithMsg(err, fmt.Sprintf("Invalid %s repo spec", kind))
 	}
@@ -116,15 +150,60 @@ func (m Map) Fetch(ctx context.Context, spec Spec) (fs.FS, error) {
 }
 
 type (
-	// Cache is a repo fetcher that caches results
+	// Cache is a repo fetcher that caches results. It is safe for concurrent
+	// use, and concurrent requests for the same repo share a single fetch.
 	Cache struct {
 		fetchers  Map
-		cache     map[string]fs.FS
+		mu        sync.Mutex
+		cache     map[string]*cacheEntry
 		local     map[string]struct{}
 		checksums map[string]string
 		hasher    h2streamhash.Hasher
 		verifier  *h2streamhash.Verifier
 		sums      map[string]string
+		replace   []Replacement
+		log       *klog.LevelLogger
+		locks     map[string]string
+		update    bool
+		resolved  map[string]*lockEntry
+		strict    bool
+	}
+
+	lockEntry struct {
+		done chan struct{}
+		lock string
+		err  error
+	}
+
+	// RepoLock is a lock of a floating repo spec
+	RepoLock struct {
+		Key  string `json:"key"`
+		Lock string `json:"lock"`
+	}
+
+	// Replacement is a local dir served in place of repos of a kind that match
+	Replacement struct {
+		Kind  string
+		Match func(repospec RepoSpec) bool
+		Fsys  fs.FS
+		Dir   string
+	}
+
+	// replacedRepoSpec is a floating repo spec which is replaced by a local
+	// dir, and is therefore never locked
+	replacedRepoSpec struct {
+		RepoSpec
+		key string
+		r   Replacement
+	}
+
+	// CacheOpt is a [Cache] constructor option
+	CacheOpt = func(c *Cache)
+
+	cacheEntry struct {
+		done chan struct{}
+		fsys fs.FS
+		err  error
 	}
 
 	// RepoChecksum is a checksum for a repo
@@ -134,21 +213,83 @@ type (
 	}
 )
 
-func NewCache(fetchers Map, local map[string]struct{}, checksums map[string]string) *Cache {
+func NewCache(fetchers Map, local map[string]struct{}, checksums map[string]string, opts ...CacheOpt) *Cache {
 	hasher := blake2bstream.NewHasher(blake2bstream.Config{})
 	verifier := h2streamhash.NewVerifier()
 	verifier.Register(hasher)
-	return &Cache{
+	c := &Cache{
 		fetchers:  fetchers,
-		cache:     map[string]fs.FS{},
+		cache:     map[string]*cacheEntry{},
 		local:     local,
 		checksums: checksums,
 		hasher:    hasher,
 		verifier:  verifier,
 		sums:      map[string]string{},
+		log:       klog.NewLevelLogger(klog.Discard{}),
+		resolved:  map[string]*lockEntry{},
+	}
+	for _, i := range opts {
+		i(c)
+	}
+	return c
+}
+
+// OptReplacements sets local dirs to serve in place of matching repos. The
+// first matching replacement is used.
+func OptReplacements(r []Replacement) CacheOpt {
+	return func(c *Cache) {
+		c.replace = r
+	}
+}
+
+// OptLocks sets existing locks of floating repo specs by lock key. If update
+// is true, floating repo specs are resolved again regardless of existing
+// locks.
+func OptLocks(locks map[string]string, update bool) CacheOpt {
+	return func(c *Cache) {
+		c.locks = locks
+		c.update = update
 	}
 }
 
+// OptStrict requires every non-local repo to have an existing checksum and
+// every floating repo spec to have an existing lock. Replaced repos are not
+// allowed in strict mode.
+func OptStrict(strict bool) CacheOpt {
+	return func(c *Cache) {
+		c.strict = strict
+	}
+}
+
+// OptLog sets the cache logger
+func OptLog(log klog.Logger) CacheOpt {
+	return func(c *Cache) {
+		c.log = klog.NewLevelLogger(log)
+	}
+}
+
+// Key implements [RepoSpec] and returns the lock key of the floating repo spec
+func (r replacedRepoSpec) Key() (string, error) {
+	return r.key, nil
+}
+
+// MarshalJSON marshals the floating repo spec
+func (r replacedRepoSpec) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.RepoSpec)
+}
+
+func (c *Cache) replacement(spec Spec) (Replacement, bool) {
+	if r, ok := spec.RepoSpec.(replacedRepoSpec); ok {
+		return r.r, true
+	}
+	for _, i := range c.replace {
+		if i.Kind == spec.Kind && i.Match(spec.RepoSpec) {
+			return i, true
+		}
+	}
+	return Replacement{}, false
+}
+
 func (c *Cache) Parse(kind string, repobytes []byte) (Spec, error) {
 	spec, err := c.fetchers.Parse(kind, repobytes)
 	if err != nil {
@@ -179,14 +320,63 @@ func (c *Cache) Get(ctx context.Context, spec Spec) (fs.FS, error) {
 	if err != nil {
 		return nil, err
 	}
-	if fsys, ok := c.cache[repokey]; ok {
-		return fsys, nil
+	c.mu.Lock()
+	if entry, ok := c.cache[repokey]; ok {
+		c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		case <-entry.done:
+			return entry.fsys, entry.err
+		}
+	}
+	entry := &cacheEntry{
+		done: make(chan struct{}),
+	}
+	c.cache[repokey] = entry
+	c.mu.Unlock()
+
+	entry.fsys, entry.err = c.fetch(ctx, spec, repokey)
+	if entry.err != nil {
+		c.mu.Lock()
+		// allow failed fetches to be retried
+		delete(c.cache, repokey)
+		c.mu.Unlock()
+	}
+	close(entry.done)
+	return entry.fsys, entry.err
+}
+
+func (c *Cache) fetch(ctx context.Context, spec Spec, repokey string) (fs.FS, error) {
+	if r, ok := c.replacement(spec); ok {
+		// replaced repos are not checksummed, and are therefore not allowed in
+		// strict mode
+		if c.strict {
+			return nil, kerrors.WithKind(nil, ErrMissingChecksum, fmt.Sprintf("Replaced repo has no checksum in strict mode: %s", repokey))
+		}
+		c.log.Warn(ctx, "Replacing repo with local dir without verifying checksums", klog.AString("repo", repokey), klog.AString("dir", r.Dir))
+		if sum, ok := c.checksums[repokey]; ok {
+			// existing checksums are kept so that they are not lost when the
+			// replacement is removed
+			c.mu.Lock()
+			c.sums[repokey] = sum
+			c.mu.Unlock()
+		}
+		return r.Fsys, nil
+	}
+	if c.strict && !c.isLocalRepo(spec.Kind) {
+		if _, ok := c.checksums[repokey]; !ok {
+			return nil, kerrors.WithKind(nil, ErrMissingChecksum, fmt.Sprintf("Repo has no recorded checksum: %s", repokey))
+		}
 	}
+	endFetch := ktrace.Start(ctx, "fetch", repokey)
 	fsys, err := c.fetchers.Fetch(ctx, spec)
+	endFetch()
 	if err != nil {
 		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to fetch repo for repo: %s", repokey))
 	}
 	if !c.isLocalRepo(spec.Kind) {
+		defer ktrace.Start(ctx, "checksum", repokey)()
 		if sum, ok := c.checksums[repokey]; ok {
 			ok, err := MerkelTreeVerify(fsys, c.verifier, sum)
 			if err != nil {
@@ -196,19 +386,188 @@ func (c *Cache) Get(ctx context.Context, spec Spec) (fs.FS, error) {
 				return nil, kerrors.WithKind(nil, ErrInvalidCache, fmt.Sprintf("Failed integrity check for repo: %s", repokey))
 			}
 		}
-		if _, ok := c.sums[repokey]; !ok {
-			sum, err := MerkelTreeHash(fsys, c.hasher)
-			if err != nil {
-				return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed computing checksum for repo: %s", repokey))
-			}
-			c.sums[repokey] = sum
+		sum, err := MerkelTreeHash(fsys, c.hasher)
+		if err != nil {
+			return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed computing checksum for repo: %s", repokey))
 		}
+		c.mu.Lock()
+		c.sums[repokey] = sum
+		c.mu.Unlock()
 	}
-	c.cache[repokey] = fsys
 	return fsys, nil
 }
 
+// Lock returns the fixed spec of a repo spec. Floating repo specs are locked
+// with an existing lock if present, and are otherwise resolved once. Floating
+// repo specs which are replaced are not locked, and no lock is recorded for
+// them.
+func (c *Cache) Lock(ctx context.Context, spec Spec) (Spec, error) {
+	f, ok := c.fetchers[spec.Kind]
+	if !ok {
+		return Spec{}, kerrors.WithKind(nil, ErrUnknownKind, fmt.Sprintf("Unknown repo kind: %s", spec.Kind))
+	}
+	l, ok := f.(Locker)
+	if !ok {
+		return spec, nil
+	}
+	key, ok := l.LockKey(spec.RepoSpec)
+	if !ok {
+		return spec, nil
+	}
+	lockkey := url.QueryEscape(spec.Kind) + ":" + key
+	if r, ok := c.replacement(spec); ok {
+		c.keepLock(lockkey)
+		return Spec{
+			Kind: spec.Kind,
+			RepoSpec: replacedRepoSpec{
+				RepoSpec: spec.RepoSpec,
+				key:      key,
+				r:        r,
+			},
+		}, nil
+	}
+	c.mu.Lock()
+	entry, ok := c.resolved[lockkey]
+	if !ok {
+		entry = &lockEntry{
+			done: make(chan struct{}),
+		}
+		c.resolved[lockkey] = entry
+	}
+	c.mu.Unlock()
+	if ok {
+		select {
+		case <-ctx.Done():
+			return Spec{}, context.Cause(ctx)
+		case <-entry.done:
+		}
+	} else {
+		if lock, ok := c.locks[lockkey]; ok && !c.update {
+			entry.lock = lock
+		} else if c.strict {
+			entry.err = kerrors.WithKind(nil, ErrMissingChecksum, "Floating repo has no recorded lock")
+		} else {
+			endLock := ktrace.Start(ctx, "lock", lockkey)
+			entry.lock, entry.err = l.Lock(ctx, spec.RepoSpec)
+			endLock()
+			if entry.err == nil {
+				c.log.Info(ctx, "Locked floating repo", klog.AString("repo", lockkey), klog.AString("lock", entry.lock))
+			}
+		}
+		if entry.err != nil {
+			c.mu.Lock()
+			// allow failed locks to be retried
+			delete(c.resolved, lockkey)
+			c.mu.Unlock()
+		}
+		close(entry.done)
+	}
+	if entry.err != nil {
+		return Spec{}, kerrors.WithMsg(entry.err, fmt.Sprintf("Failed to lock repo: %s", lockkey))
+	}
+	repospec, err := l.ApplyLock(spec.RepoSpec, entry.lock)
+	if err != nil {
+		return Spec{}, kerrors.WithMsg(err, fmt.Sprintf("Failed to apply lock for repo: %s", lockkey))
+	}
+	if _, err := repospec.Key(); err != nil {
+		return Spec{}, kerrors.WithMsg(err, fmt.Sprintf("Invalid locked %s repo spec", spec.Kind))
+	}
+	return Spec{
+		Kind:     spec.Kind,
+		RepoSpec: repospec,
+	}, nil
+}
+
+// keepLock keeps the existing lock of a replaced floating repo spec so that it
+// is not lost when the replacement is removed
+func (c *Cache) keepLock(lockkey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.resolved[lockkey]; ok {
+		return
+	}
+	lock, ok := c.locks[lockkey]
+	if !ok {
+		return
+	}
+	entry := &lockEntry{
+		done: make(chan struct{}),
+		lock: lock,
+	}
+	close(entry.done)
+	c.resolved[lockkey] = entry
+}
+
+// Locks returns the locks of floating repo specs sorted by lock key
+func (c *Cache) Locks() []RepoLock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.resolved))
+	for k, v := range c.resolved {
+		select {
+		case <-v.done:
+			if v.err == nil {
+				keys = append(keys, k)
+			}
+		default:
+		}
+	}
+	slices.Sort(keys)
+	locks := make([]RepoLock, 0, len(keys))
+	for _, i := range keys {
+		locks = append(locks, RepoLock{
+			Key:  i,
+			Lock: c.resolved[i].lock,
+		})
+	}
+	return locks
+}
+
+// UnusedLocks returns existing locks that were not used sorted by lock key
+func (c *Cache) UnusedLocks() []RepoLock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.locks))
+	for k := range c.locks {
+		if _, ok := c.resolved[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	locks := make([]RepoLock, 0, len(keys))
+	for _, i := range keys {
+		locks = append(locks, RepoLock{
+			Key:  i,
+			Lock: c.locks[i],
+		})
+	}
+	return locks
+}
+
+// UnusedSums returns existing checksums that were not used sorted by repo key
+func (c *Cache) UnusedSums() []RepoChecksum {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.checksums))
+	for k := range c.checksums {
+		if _, ok := c.sums[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	sums := make([]RepoChecksum, 0, len(keys))
+	for _, i := range keys {
+		sums = append(sums, RepoChecksum{
+			Key: i,
+			Sum: c.checksums[i],
+		})
+	}
+	return sums
+}
+
 func (c *Cache) Sums() []RepoChecksum {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	keys := make([]string, 0, len(c.sums))
 	for k := range c.sums {
 		keys = append(keys, k)
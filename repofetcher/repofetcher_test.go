@@ -2,11 +2,15 @@ package repofetcher_test
 
 import (
 	"context"
+	"fmt"
 	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
 
 	"github.com/stretchr/testify/require"
 	"xorkevin.dev/anvil/repofetcher"
@@ -116,3 +120,292 @@ foobar
 		assert.True(ok)
 	})
 }
+
+type (
+	mockRepoSpec struct {
+		name string
+	}
+
+	mockFetcher struct {
+		mu      sync.Mutex
+		fetches map[string]int
+		fsys    fs.FS
+	}
+
+	mockLocker struct {
+		*mockFetcher
+		locks map[string]int
+	}
+)
+
+func (s mockRepoSpec) Key() (string, error) {
+	return s.name, nil
+}
+
+func (f *mockFetcher) Parse(repobytes []byte) (repofetcher.RepoSpec, error) {
+	return mockRepoSpec{name: string(repobytes)}, nil
+}
+
+func (f *mockFetcher) Fetch(ctx context.Context, spec repofetcher.RepoSpec) (fs.FS, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fetches[spec.(mockRepoSpec).name]++
+	return f.fsys, nil
+}
+
+func (f *mockLocker) LockKey(spec repofetcher.RepoSpec) (string, bool) {
+	name := spec.(mockRepoSpec).name
+	return name, strings.HasPrefix(name, "floating")
+}
+
+func (f *mockLocker) Lock(ctx context.Context, spec repofetcher.RepoSpec) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.locks[spec.(mockRepoSpec).name]++
+	return "new", nil
+}
+
+func (f *mockLocker) ApplyLock(spec repofetcher.RepoSpec, lock string) (repofetcher.RepoSpec, error) {
+	return mockRepoSpec{name: spec.(mockRepoSpec).name + "-" + lock}, nil
+}
+
+func TestCache(t *testing.T) {
+	t.Parallel()
+
+	t.Run("concurrent gets share a fetch", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		fetcher := &mockFetcher{
+			fetches: map[string]int{},
+			fsys: fstest.MapFS{
+				"foo.txt": &fstest.MapFile{Data: []byte("hello, world"), Mode: 0o644},
+			},
+		}
+		cache := repofetcher.NewCache(repofetcher.Map{"mock": fetcher}, nil, nil)
+
+		var wg sync.WaitGroup
+		errs := make([]error, 16)
+		for i := range errs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				spec, err := cache.Parse("mock", []byte(fmt.Sprintf("repo%d", i%2)))
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				_, errs[i] = cache.Get(context.Background(), spec)
+			}()
+		}
+		wg.Wait()
+		for _, i := range errs {
+			assert.NoError(i)
+		}
+
+		assert.Equal(map[string]int{"repo0": 1, "repo1": 1}, fetcher.fetches)
+		sums := cache.Sums()
+		assert.Len(sums, 2)
+		assert.Equal("mock:repo0", sums[0].Key)
+		assert.Equal("mock:repo1", sums[1].Key)
+		assert.Equal(sums[0].Sum, sums[1].Sum)
+	})
+	t.Run("replacements serve local dirs", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		fetcher := &mockFetcher{
+			fetches: map[string]int{},
+			fsys: fstest.MapFS{
+				"foo.txt": &fstest.MapFile{Data: []byte("remote"), Mode: 0o644},
+			},
+		}
+		cache := repofetcher.NewCache(
+			repofetcher.Map{"mock": fetcher},
+			nil,
+			map[string]string{"mock:repo0": "pinned"},
+			repofetcher.OptReplacements([]repofetcher.Replacement{
+				{
+					Kind: "mock",
+					Match: func(repospec repofetcher.RepoSpec) bool {
+						return repospec.(mockRepoSpec).name != "repo2"
+					},
+					Fsys: fstest.MapFS{
+						"foo.txt": &fstest.MapFile{Data: []byte("local"), Mode: 0o644},
+					},
+					Dir: "local",
+				},
+			}),
+		)
+
+		for _, i := range []string{"repo0", "repo1", "repo2"} {
+			spec, err := cache.Parse("mock", []byte(i))
+			assert.NoError(err)
+			fsys, err := cache.Get(context.Background(), spec)
+			assert.NoError(err)
+			b, err := fs.ReadFile(fsys, "foo.txt")
+			assert.NoError(err)
+			if i == "repo2" {
+				assert.Equal("remote", string(b))
+			} else {
+				assert.Equal("local", string(b))
+			}
+		}
+
+		assert.Equal(map[string]int{"repo2": 1}, fetcher.fetches)
+		sums := cache.Sums()
+		assert.Len(sums, 2)
+		assert.Equal(repofetcher.RepoChecksum{Key: "mock:repo0", Sum: "pinned"}, sums[0])
+		assert.Equal("mock:repo2", sums[1].Key)
+	})
+	t.Run("replacements are not locked", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		fetcher := &mockLocker{
+			mockFetcher: &mockFetcher{
+				fetches: map[string]int{},
+				fsys: fstest.MapFS{
+					"foo.txt": &fstest.MapFile{Data: []byte("remote"), Mode: 0o644},
+				},
+			},
+			locks: map[string]int{},
+		}
+		cache := repofetcher.NewCache(
+			repofetcher.Map{"mock": fetcher},
+			nil,
+			nil,
+			repofetcher.OptLocks(map[string]string{"mock:floating0": "old", "mock:floating1": "old"}, true),
+			repofetcher.OptReplacements([]repofetcher.Replacement{
+				{
+					Kind: "mock",
+					Match: func(repospec repofetcher.RepoSpec) bool {
+						return repospec.(mockRepoSpec).name == "floating0"
+					},
+					Fsys: fstest.MapFS{
+						"foo.txt": &fstest.MapFile{Data: []byte("local"), Mode: 0o644},
+					},
+					Dir: "local",
+				},
+			}),
+		)
+
+		for _, i := range []string{"floating0", "floating1"} {
+			spec, err := cache.Parse("mock", []byte(i))
+			assert.NoError(err)
+			spec, err = cache.Lock(context.Background(), spec)
+			assert.NoError(err)
+			fsys, err := cache.Get(context.Background(), spec)
+			assert.NoError(err)
+			b, err := fs.ReadFile(fsys, "foo.txt")
+			assert.NoError(err)
+			if i == "floating0" {
+				assert.Equal("mock:floating0", spec.String())
+				assert.Equal("local", string(b))
+			} else {
+				assert.Equal("mock:floating1-new", spec.String())
+				assert.Equal("remote", string(b))
+			}
+		}
+
+		assert.Equal(map[string]int{"floating1": 1}, fetcher.locks)
+		assert.Equal(map[string]int{"floating1-new": 1}, fetcher.fetches)
+		// the existing lock of the replaced repo is kept
+		assert.Equal([]repofetcher.RepoLock{
+			{Key: "mock:floating0", Lock: "old"},
+			{Key: "mock:floating1", Lock: "new"},
+		}, cache.Locks())
+		sums := cache.Sums()
+		assert.Len(sums, 1)
+		assert.Equal("mock:floating1-new", sums[0].Key)
+	})
+	t.Run("strict mode requires checksums", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		fetcher := &mockFetcher{
+			fetches: map[string]int{},
+			fsys: fstest.MapFS{
+				"foo.txt": &fstest.MapFile{Data: []byte("hello, world"), Mode: 0o644},
+			},
+		}
+		sum, err := repofetcher.MerkelTreeHash(fetcher.fsys, blake2bstream.NewHasher(blake2bstream.Config{}))
+		assert.NoError(err)
+		cache := repofetcher.NewCache(
+			repofetcher.Map{"mock": fetcher},
+			nil,
+			map[string]string{"mock:repo0": sum, "mock:unused": sum},
+			repofetcher.OptStrict(true),
+		)
+
+		spec, err := cache.Parse("mock", []byte("repo0"))
+		assert.NoError(err)
+		_, err = cache.Get(context.Background(), spec)
+		assert.NoError(err)
+
+		spec, err = cache.Parse("mock", []byte("repo1"))
+		assert.NoError(err)
+		_, err = cache.Get(context.Background(), spec)
+		assert.ErrorIs(err, repofetcher.ErrMissingChecksum)
+
+		assert.Equal(map[string]int{"repo0": 1}, fetcher.fetches)
+		assert.Equal([]repofetcher.RepoChecksum{{Key: "mock:unused", Sum: sum}}, cache.UnusedSums())
+	})
+	t.Run("strict mode rejects replacements", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		fetcher := &mockLocker{
+			mockFetcher: &mockFetcher{
+				fetches: map[string]int{},
+				fsys: fstest.MapFS{
+					"foo.txt": &fstest.MapFile{Data: []byte("remote"), Mode: 0o644},
+				},
+			},
+			locks: map[string]int{},
+		}
+		cache := repofetcher.NewCache(
+			repofetcher.Map{"mock": fetcher},
+			nil,
+			nil,
+			repofetcher.OptStrict(true),
+			repofetcher.OptReplacements([]repofetcher.Replacement{
+				{
+					Kind: "mock",
+					Match: func(repospec repofetcher.RepoSpec) bool {
+						return repospec.(mockRepoSpec).name != "repo1"
+					},
+					Fsys: fstest.MapFS{
+						"foo.txt": &fstest.MapFile{Data: []byte("local"), Mode: 0o644},
+					},
+					Dir: "local",
+				},
+			}),
+		)
+
+		// replaced fixed and floating repos are not checksummed
+		for _, i := range []string{"repo0", "floating0"} {
+			spec, err := cache.Parse("mock", []byte(i))
+			assert.NoError(err)
+			spec, err = cache.Lock(context.Background(), spec)
+			assert.NoError(err)
+			_, err = cache.Get(context.Background(), spec)
+			assert.ErrorIs(err, repofetcher.ErrMissingChecksum)
+		}
+
+		spec, err := cache.Parse("mock", []byte("repo1"))
+		assert.NoError(err)
+		_, err = cache.Get(context.Background(), spec)
+		assert.ErrorIs(err, repofetcher.ErrMissingChecksum)
+
+		assert.Len(fetcher.locks, 0)
+		assert.Len(fetcher.fetches, 0)
+		assert.Len(cache.Sums(), 0)
+		assert.Len(cache.Locks(), 0)
+	})
+}
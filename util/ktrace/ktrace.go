@@ -0,0 +1,259 @@
+package ktrace
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"xorkevin.dev/kerrors"
+)
+
+var (
+	// ErrUnknownTimingFormat is returned when the timing report format is not
+	// supported
+	ErrUnknownTimingFormat errUnknownTimingFormat
+)
+
+type (
+	errUnknownTimingFormat struct{}
+)
+
+func (e errUnknownTimingFormat) Error() string {
+	return "Unknown timing format"
+}
+
+const (
+	// FormatTable is a text table timing report
+	FormatTable = "table"
+	// FormatTrace is a chrome trace json timing report
+	FormatTrace = "trace"
+)
+
+type (
+	// Recorder records timed spans. It is safe for concurrent use.
+	Recorder struct {
+		mu    sync.Mutex
+		start time.Time
+		spans []Span
+	}
+
+	// Span is a timed stage of work. Start is relative to the creation of its
+	// recorder.
+	Span struct {
+		Stage    string
+		Name     string
+		Start    time.Duration
+		Duration time.Duration
+	}
+
+	ctxKeyRecorder struct{}
+)
+
+// NewRecorder creates a new [*Recorder]
+func NewRecorder() *Recorder {
+	return &Recorder{
+		start: time.Now(),
+	}
+}
+
+// WithRecorder returns a context holding a recorder
+func WithRecorder(ctx context.Context, r *Recorder) context.Context {
+	return context.WithValue(ctx, ctxKeyRecorder{}, r)
+}
+
+// GetRecorder returns the recorder of a context or nil
+func GetRecorder(ctx context.Context) *Recorder {
+	v, _ := ctx.Value(ctxKeyRecorder{}).(*Recorder)
+	return v
+}
+
+// Start starts a span recorded to the recorder of the context, and returns a
+// function that ends it. Nothing is recorded if the context has no recorder.
+func Start(ctx context.Context, stage, name string) func() {
+	r := GetRecorder(ctx)
+	if r == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		end := time.Now()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.spans = append(r.spans, Span{
+			Stage:    stage,
+			Name:     name,
+			Start:    start.Sub(r.start),
+			Duration: end.Sub(start),
+		})
+	}
+}
+
+// Spans returns the recorded spans sorted by start
+func (r *Recorder) Spans() []Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	spans := slices.Clone(r.spans)
+	slices.SortStableFunc(spans, func(a, b Span) int {
+		return cmp.Or(
+			cmp.Compare(a.Start, b.Start),
+			// longer spans contain shorter spans with the same start
+			cmp.Compare(b.Duration, a.Duration),
+		)
+	})
+	return spans
+}
+
+func fmtDuration(d time.Duration) string {
+	return d.Round(time.Microsecond).String()
+}
+
+// WriteTable writes a summary of the total time of each stage followed by
+// every span from slowest to fastest as text tables. Time of nested spans is
+// included in the time of their parent spans.
+func WriteTable(w io.Writer, spans []Span) error {
+	type stageSummary struct {
+		stage string
+		count int
+		total time.Duration
+		max   time.Duration
+	}
+	var stages []*stageSummary
+	byStage := map[string]*stageSummary{}
+	for _, i := range spans {
+		s, ok := byStage[i.Stage]
+		if !ok {
+			s = &stageSummary{stage: i.Stage}
+			byStage[i.Stage] = s
+			stages = append(stages, s)
+		}
+		s.count++
+		s.total += i.Duration
+		s.max = max(s.max, i.Duration)
+	}
+	slices.SortFunc(stages, func(a, b *stageSummary) int {
+		return cmp.Compare(a.stage, b.stage)
+	})
+	sorted := slices.Clone(spans)
+	slices.SortStableFunc(sorted, func(a, b Span) int {
+		return cmp.Compare(b.Duration, a.Duration)
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STAGE\tCOUNT\tTOTAL\tMAX")
+	for _, i := range stages {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", i.stage, i.count, fmtDuration(i.total), fmtDuration(i.max))
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "STAGE\tDURATION\tNAME")
+	for _, i := range sorted {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", i.Stage, fmtDuration(i.Duration), i.Name)
+	}
+	if err := tw.Flush(); err != nil {
+		return kerrors.WithMsg(err, "Failed writing timing table")
+	}
+	return nil
+}
+
+type (
+	chromeTrace struct {
+		TraceEvents     []chromeTraceEvent `json:"traceEvents"`
+		DisplayTimeUnit string             `json:"displayTimeUnit"`
+	}
+
+	chromeTraceEvent struct {
+		Name string `json:"name"`
+		Cat  string `json:"cat"`
+		Ph   string `json:"ph"`
+		Ts   int64  `json:"ts"`
+		Dur  int64  `json:"dur"`
+		Pid  int    `json:"pid"`
+		Tid  int    `json:"tid"`
+	}
+)
+
+// spanLanes assigns spans sorted by start to lanes such that spans in the same
+// lane are either disjoint or nested, as required of complete events on the
+// same thread in a chrome trace
+func spanLanes(spans []Span) []int {
+	lanes := make([]int, len(spans))
+	// each lane is a stack of the ends of open spans
+	var stacks [][]time.Duration
+	for n, i := range spans {
+		end := i.Start + i.Duration
+		lane := -1
+		for l, s := range stacks {
+			for len(s) > 0 && s[len(s)-1] <= i.Start {
+				s = s[:len(s)-1]
+			}
+			stacks[l] = s
+			if len(s) == 0 || s[len(s)-1] >= end {
+				lane = l
+				break
+			}
+		}
+		if lane < 0 {
+			lane = len(stacks)
+			stacks = append(stacks, nil)
+		}
+		stacks[lane] = append(stacks[lane], end)
+		lanes[n] = lane
+	}
+	return lanes
+}
+
+// WriteChromeTrace writes spans sorted by start as chrome trace event format
+// json, which may be viewed in chrome://tracing or Perfetto
+func WriteChromeTrace(w io.Writer, spans []Span) error {
+	lanes := spanLanes(spans)
+	events := make([]chromeTraceEvent, 0, len(spans))
+	for n, i := range spans {
+		events = append(events, chromeTraceEvent{
+			Name: i.Name,
+			Cat:  i.Stage,
+			Ph:   "X",
+			Ts:   i.Start.Microseconds(),
+			Dur:  i.Duration.Microseconds(),
+			Pid:  1,
+			Tid:  lanes[n] + 1,
+		})
+	}
+	b, err := json.Marshal(chromeTrace{
+		TraceEvents:     events,
+		DisplayTimeUnit: "ms",
+	})
+	if err != nil {
+		return kerrors.WithMsg(err, "Failed to marshal chrome trace")
+	}
+	if _, err := w.Write(b); err != nil {
+		return kerrors.WithMsg(err, "Failed writing chrome trace")
+	}
+	return nil
+}
+
+// CheckFormat returns an error if the timing report format is not supported
+func CheckFormat(format string) error {
+	switch format {
+	case FormatTable, FormatTrace:
+		return nil
+	default:
+		return kerrors.WithKind(nil, ErrUnknownTimingFormat, fmt.Sprintf("Unknown timing format: %s", format))
+	}
+}
+
+// WriteReport writes spans as a timing report of a format
+func WriteReport(w io.Writer, format string, spans []Span) error {
+	switch format {
+	case FormatTable:
+		return WriteTable(w, spans)
+	case FormatTrace:
+		return WriteChromeTrace(w, spans)
+	default:
+		return kerrors.WithKind(nil, ErrUnknownTimingFormat, fmt.Sprintf("Unknown timing format: %s", format))
+	}
+}
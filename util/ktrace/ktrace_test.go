@@ -0,0 +1,125 @@
+package ktrace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorder(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	// spans are not recorded without a recorder
+	Start(context.Background(), "fetch", "none")()
+
+	r := NewRecorder()
+	ctx := WithRecorder(context.Background(), r)
+	end := Start(ctx, "parse", "outer")
+	Start(ctx, "fetch", "inner")()
+	end()
+
+	spans := map[string]Span{}
+	for _, i := range r.Spans() {
+		spans[i.Name] = i
+	}
+	assert.Len(spans, 2)
+	outer, inner := spans["outer"], spans["inner"]
+	assert.Equal("parse", outer.Stage)
+	assert.Equal("fetch", inner.Stage)
+	assert.True(outer.Start <= inner.Start)
+	assert.True(inner.Start+inner.Duration <= outer.Start+outer.Duration)
+}
+
+func TestWriteChromeTrace(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Name  string
+		Spans []Span
+		Lanes []int
+	}{
+		{
+			Name: "nested and disjoint spans share a lane",
+			Spans: []Span{
+				{Stage: "parse", Name: "a", Start: 0, Duration: 10 * time.Millisecond},
+				{Stage: "fetch", Name: "b", Start: 1 * time.Millisecond, Duration: 5 * time.Millisecond},
+				{Stage: "render", Name: "c", Start: 10 * time.Millisecond, Duration: 5 * time.Millisecond},
+			},
+			Lanes: []int{1, 1, 1},
+		},
+		{
+			Name: "overlapping spans use separate lanes",
+			Spans: []Span{
+				{Stage: "render", Name: "a", Start: 0, Duration: 10 * time.Millisecond},
+				{Stage: "render", Name: "b", Start: 5 * time.Millisecond, Duration: 10 * time.Millisecond},
+				{Stage: "render", Name: "c", Start: 12 * time.Millisecond, Duration: 1 * time.Millisecond},
+			},
+			Lanes: []int{1, 2, 1},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			var b bytes.Buffer
+			assert.NoError(WriteChromeTrace(&b, tc.Spans))
+			var trace chromeTrace
+			assert.NoError(json.Unmarshal(b.Bytes(), &trace))
+			assert.Len(trace.TraceEvents, len(tc.Spans))
+			for n, i := range trace.TraceEvents {
+				assert.Equal(tc.Spans[n].Name, i.Name)
+				assert.Equal(tc.Spans[n].Stage, i.Cat)
+				assert.Equal("X", i.Ph)
+				assert.Equal(tc.Spans[n].Start.Microseconds(), i.Ts)
+				assert.Equal(tc.Spans[n].Duration.Microseconds(), i.Dur)
+				assert.Equal(tc.Lanes[n], i.Tid)
+			}
+		})
+	}
+}
+
+func TestWriteTable(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	var b bytes.Buffer
+	assert.NoError(WriteTable(&b, []Span{
+		{Stage: "render", Name: "a", Start: 0, Duration: 2 * time.Millisecond},
+		{Stage: "fetch", Name: "b", Start: 0, Duration: 5 * time.Millisecond},
+		{Stage: "render", Name: "c", Start: 0, Duration: 3 * time.Millisecond},
+	}))
+	assert.Equal(strings.Join([]string{
+		"STAGE   COUNT  TOTAL  MAX",
+		"fetch   1      5ms    5ms",
+		"render  2      5ms    3ms",
+		"",
+		"STAGE   DURATION  NAME",
+		"fetch   5ms       b",
+		"render  3ms       c",
+		"render  2ms       a",
+		"",
+	}, "\n"), b.String())
+}
+
+func TestWriteReport(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	var b bytes.Buffer
+	assert.NoError(CheckFormat(FormatTable))
+	assert.NoError(CheckFormat(FormatTrace))
+	assert.ErrorIs(CheckFormat("bogus"), ErrUnknownTimingFormat)
+	assert.ErrorIs(WriteReport(&b, "bogus", nil), ErrUnknownTimingFormat)
+	assert.NoError(WriteReport(&b, FormatTrace, nil))
+	assert.Equal(`{"traceEvents":[],"displayTimeUnit":"ms"}`, b.String())
+}
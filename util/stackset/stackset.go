@@ -42,6 +42,18 @@ func (s *StackSet[T]) Slice() []T {
 	return ret
 }
 
+// Clone returns an independent copy of the stack set
+func (s *StackSet[T]) Clone() *StackSet[T] {
+	set := make(map[T]struct{}, len(s.set))
+	for k := range s.set {
+		set[k] = struct{}{}
+	}
+	return &StackSet[T]{
+		set:   set,
+		stack: s.Slice(),
+	}
+}
+
 type (
 	Any struct {
 		set   map[any]struct{}
@@ -0,0 +1,138 @@
+package starlarkmod
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"xorkevin.dev/anvil/util/stackset"
+)
+
+// ErrImportCycle is returned when module dependencies form a cycle
+var ErrImportCycle errImportCycle
+
+type (
+	errImportCycle struct{}
+)
+
+func (e errImportCycle) Error() string {
+	return "Import cycle"
+}
+
+type (
+	// Loader loads starlark modules from a file system. Each module is executed
+	// at most once. It is not safe for concurrent use.
+	Loader struct {
+		root     fs.FS
+		modCache map[string]*loadedModule
+		set      *stackset.StackSet[string]
+		stderr   io.Writer
+		universe map[string]starlark.StringDict
+		globals  func(module string) starlark.StringDict
+	}
+
+	loadedModule struct {
+		vals starlark.StringDict
+		err  error
+	}
+
+	fromLoader struct {
+		ctx  context.Context
+		l    *Loader
+		from string
+	}
+
+	writerPrinter struct {
+		w io.Writer
+	}
+)
+
+// NewLoader creates a new [*Loader]. Modules named by a key of universe load
+// its value rather than a file, and globals returns the predeclared values of
+// a module.
+func NewLoader(root fs.FS, stderr io.Writer, universe map[string]starlark.StringDict, globals func(module string) starlark.StringDict) *Loader {
+	return &Loader{
+		root:     root,
+		modCache: map[string]*loadedModule{},
+		set:      stackset.New[string](),
+		stderr:   stderr,
+		universe: universe,
+		globals:  globals,
+	}
+}
+
+// Print returns a starlark print function which writes to w
+func Print(w io.Writer) func(_ *starlark.Thread, msg string) {
+	return writerPrinter{w: w}.print
+}
+
+func (w writerPrinter) print(_ *starlark.Thread, msg string) {
+	fmt.Fprintln(w.w, msg)
+}
+
+func (l *Loader) loadFile(ctx context.Context, module string) (starlark.StringDict, error) {
+	if m, ok := l.modCache[module]; ok {
+		return m.vals, m.err
+	}
+	var vals starlark.StringDict
+	b, err := fs.ReadFile(l.root, module)
+	if err == nil {
+		if !l.set.Push(module) {
+			err = fmt.Errorf("%w: Import cycle on module: %s -> %s", ErrImportCycle, strings.Join(l.set.Slice(), ","), module)
+		} else {
+			thread := &starlark.Thread{
+				Name:  module,
+				Print: Print(l.stderr),
+				Load:  fromLoader{ctx: ctx, l: l, from: module}.load,
+			}
+			thread.SetLocal("ctx", ctx)
+			vals, err = starlark.ExecFile(thread, module, b, l.globals(module))
+			v, ok := l.set.Pop()
+			if !ok {
+				err = errors.Join(err, fmt.Errorf("%w: Failed checking import cycle due to missing element on module %s", ErrImportCycle, module))
+			} else if v != module {
+				err = errors.Join(err, fmt.Errorf("%w: Failed checking import cycle due to mismatched element on module %s, %s; %s", ErrImportCycle, module, v, strings.Join(l.set.Slice(), ",")))
+			}
+			if err != nil {
+				vals = nil
+			}
+		}
+	}
+	l.modCache[module] = &loadedModule{
+		vals: vals,
+		err:  err,
+	}
+	return vals, err
+}
+
+// Load loads a module relative to the module from, or relative to the root if
+// the module is absolute
+func (l *Loader) Load(ctx context.Context, from, module string) (starlark.StringDict, error) {
+	if m, ok := l.universe[module]; ok {
+		return m, nil
+	}
+
+	var name string
+	if path.IsAbs(module) {
+		name = path.Clean(module[1:])
+	} else {
+		name = path.Join(path.Dir(from), module)
+	}
+	if !fs.ValidPath(name) {
+		return nil, fmt.Errorf("%w: Invalid filepath %s from %s", fs.ErrInvalid, module, from)
+	}
+	vals, err := l.loadFile(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read module %s: %w", name, err)
+	}
+	return vals, nil
+}
+
+func (l fromLoader) load(_ *starlark.Thread, module string) (starlark.StringDict, error) {
+	return l.l.Load(l.ctx, l.from, module)
+}
@@ -0,0 +1,258 @@
+package udiff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+type (
+	// OpKind is a kind of diff operation
+	OpKind int
+
+	// Edit is a diff operation on a line
+	Edit struct {
+		Kind OpKind
+		Line string
+	}
+)
+
+const (
+	// OpEqual is an unchanged line
+	OpEqual OpKind = iota
+	// OpDelete is a removed line
+	OpDelete
+	// OpInsert is an added line
+	OpInsert
+)
+
+// SplitLines splits bytes into lines which retain their line endings
+func SplitLines(b []byte) []string {
+	var lines []string
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			lines = append(lines, string(b))
+			break
+		}
+		lines = append(lines, string(b[:i+1]))
+		b = b[i+1:]
+	}
+	return lines
+}
+
+type (
+	differ struct {
+		a     []string
+		b     []string
+		vf    []int
+		vb    []int
+		off   int
+		edits []Edit
+	}
+)
+
+// Lines computes a minimal line diff from a to b with the linear space
+// variant of the Myers algorithm
+func Lines(a, b []string) []Edit {
+	if len(a)+len(b) == 0 {
+		return nil
+	}
+	maxd := len(a) + len(b)
+	d := &differ{
+		a:     a,
+		b:     b,
+		vf:    make([]int, 2*maxd+3),
+		vb:    make([]int, 2*maxd+3),
+		off:   maxd + 1,
+		edits: make([]Edit, 0, max(len(a), len(b))),
+	}
+	d.compare(0, len(a), 0, len(b))
+	return d.edits
+}
+
+// compare appends the edits from a[a0:a1] to b[b0:b1]
+func (d *differ) compare(a0, a1, b0, b1 int) {
+	for a0 < a1 && b0 < b1 && d.a[a0] == d.b[b0] {
+		d.edits = append(d.edits, Edit{Kind: OpEqual, Line: d.a[a0]})
+		a0++
+		b0++
+	}
+	suffix := 0
+	for a0 < a1-suffix && b0 < b1-suffix && d.a[a1-suffix-1] == d.b[b1-suffix-1] {
+		suffix++
+	}
+	a1 -= suffix
+	b1 -= suffix
+	switch {
+	case a0 == a1:
+		for _, i := range d.b[b0:b1] {
+			d.edits = append(d.edits, Edit{Kind: OpInsert, Line: i})
+		}
+	case b0 == b1:
+		for _, i := range d.a[a0:a1] {
+			d.edits = append(d.edits, Edit{Kind: OpDelete, Line: i})
+		}
+	default:
+		x, y, u, v, ok := d.middleSnake(a0, a1, b0, b1)
+		if !ok {
+			// a middle snake always exists, but a non-minimal diff is preferred
+			// to failing
+			for _, i := range d.a[a0:a1] {
+				d.edits = append(d.edits, Edit{Kind: OpDelete, Line: i})
+			}
+			for _, i := range d.b[b0:b1] {
+				d.edits = append(d.edits, Edit{Kind: OpInsert, Line: i})
+			}
+			break
+		}
+		d.compare(a0, x, b0, y)
+		for _, i := range d.a[x:u] {
+			d.edits = append(d.edits, Edit{Kind: OpEqual, Line: i})
+		}
+		d.compare(u, a1, v, b1)
+	}
+	for _, i := range d.a[a1 : a1+suffix] {
+		d.edits = append(d.edits, Edit{Kind: OpEqual, Line: i})
+	}
+}
+
+// middleSnake returns the start (x, y) and end (u, v) of the middle snake of
+// a minimal edit path from a[a0:a1] to b[b0:b1] by searching forward from the
+// start and backward from the end until the paths overlap. Both ranges must
+// be non-empty. ok is false if no middle snake is found.
+func (d *differ) middleSnake(a0, a1, b0, b1 int) (int, int, int, int, bool) {
+	n, m := a1-a0, b1-b0
+	delta := n - m
+	odd := delta%2 != 0
+	vf, vb, off := d.vf, d.vb, d.off
+	vf[off+1] = 0
+	vb[off+1] = 0
+	for e := 0; e <= (n+m+1)/2; e++ {
+		for k := -e; k <= e; k += 2 {
+			var x int
+			if k == -e || (k != e && vf[off+k-1] < vf[off+k+1]) {
+				x = vf[off+k+1]
+			} else {
+				x = vf[off+k-1] + 1
+			}
+			y := x - k
+			sx, sy := x, y
+			for x < n && y < m && d.a[a0+x] == d.b[b0+y] {
+				x++
+				y++
+			}
+			vf[off+k] = x
+			if kr := delta - k; odd && kr >= -(e-1) && kr <= e-1 && x+vb[off+kr] >= n {
+				return a0 + sx, b0 + sy, a0 + x, b0 + y, true
+			}
+		}
+		// the backward search is a forward search from the ends of a and b
+		for kr := -e; kr <= e; kr += 2 {
+			var x int
+			if kr == -e || (kr != e && vb[off+kr-1] < vb[off+kr+1]) {
+				x = vb[off+kr+1]
+			} else {
+				x = vb[off+kr-1] + 1
+			}
+			y := x - kr
+			sx, sy := x, y
+			for x < n && y < m && d.a[a1-x-1] == d.b[b1-y-1] {
+				x++
+				y++
+			}
+			vb[off+kr] = x
+			if k := delta - kr; !odd && k >= -e && k <= e && vf[off+k]+x >= n {
+				return a1 - x, b1 - y, a1 - sx, b1 - sy, true
+			}
+		}
+	}
+	return 0, 0, 0, 0, false
+}
+
+type (
+	hunk struct {
+		start int
+		end   int
+	}
+)
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// Unified returns a unified diff from old to new with n lines of context. An
+// empty string is returned if old and new are equal.
+func Unified(oldName, newName string, old, new []byte, n int) string {
+	edits := Lines(SplitLines(old), SplitLines(new))
+
+	var hunks []hunk
+	for i, e := range edits {
+		if e.Kind == OpEqual {
+			continue
+		}
+		start := max(i-n, 0)
+		end := min(i+1+n, len(edits))
+		if l := len(hunks); l > 0 && start <= hunks[l-1].end {
+			hunks[l-1].end = end
+		} else {
+			hunks = append(hunks, hunk{start: start, end: end})
+		}
+	}
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var s strings.Builder
+	s.WriteString("--- ")
+	s.WriteString(oldName)
+	s.WriteString("\n+++ ")
+	s.WriteString(newName)
+	s.WriteString("\n")
+	aLine, bLine, idx := 0, 0, 0
+	for _, h := range hunks {
+		for ; idx < h.start; idx++ {
+			if edits[idx].Kind != OpInsert {
+				aLine++
+			}
+			if edits[idx].Kind != OpDelete {
+				bLine++
+			}
+		}
+		aCount, bCount := 0, 0
+		for _, e := range edits[h.start:h.end] {
+			if e.Kind != OpInsert {
+				aCount++
+			}
+			if e.Kind != OpDelete {
+				bCount++
+			}
+		}
+		s.WriteString("@@ -")
+		s.WriteString(hunkRange(aLine, aCount))
+		s.WriteString(" +")
+		s.WriteString(hunkRange(bLine, bCount))
+		s.WriteString(" @@\n")
+		for _, e := range edits[h.start:h.end] {
+			switch e.Kind {
+			case OpDelete:
+				s.WriteString("-")
+			case OpInsert:
+				s.WriteString("+")
+			default:
+				s.WriteString(" ")
+			}
+			s.WriteString(e.Line)
+			if !strings.HasSuffix(e.Line, "\n") {
+				s.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+	return s.String()
+}
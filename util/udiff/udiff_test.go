@@ -0,0 +1,196 @@
+package udiff
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnified(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Name string
+		Old  string
+		New  string
+		Exp  string
+	}{
+		{
+			Name: "equal",
+			Old:  "foo\nbar\n",
+			New:  "foo\nbar\n",
+			Exp:  "",
+		},
+		{
+			Name: "new file",
+			Old:  "",
+			New:  "foo\nbar\n",
+			Exp: `--- a
++++ b
+@@ -0,0 +1,2 @@
++foo
++bar
+`,
+		},
+		{
+			Name: "deleted file",
+			Old:  "foo\n",
+			New:  "",
+			Exp: `--- a
++++ b
+@@ -1 +0,0 @@
+-foo
+`,
+		},
+		{
+			Name: "changed lines with context",
+			Old:  "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+			New:  "1\n2\n3\nfour\n5\n6\n7\n8\n9\nten\n",
+			Exp: `--- a
++++ b
+@@ -1,10 +1,10 @@
+ 1
+ 2
+ 3
+-4
++four
+ 5
+ 6
+ 7
+ 8
+ 9
+-10
++ten
+`,
+		},
+		{
+			Name: "separate hunks",
+			Old:  "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			New:  "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve",
+			Exp: `--- a
++++ b
+@@ -1,4 +1,4 @@
+-1
++one
+ 2
+ 3
+ 4
+@@ -9,4 +9,4 @@
+ 9
+ 10
+ 11
+-12
++twelve
+\ No newline at end of file
+`,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+			assert.Equal(tc.Exp, Unified("a", "b", []byte(tc.Old), []byte(tc.New), 3))
+		})
+	}
+}
+
+func applyEdits(edits []Edit) ([]string, []string) {
+	var a, b []string
+	for _, i := range edits {
+		if i.Kind != OpInsert {
+			a = append(a, i.Line)
+		}
+		if i.Kind != OpDelete {
+			b = append(b, i.Line)
+		}
+	}
+	return a, b
+}
+
+func countChanges(edits []Edit) int {
+	count := 0
+	for _, i := range edits {
+		if i.Kind != OpEqual {
+			count++
+		}
+	}
+	return count
+}
+
+// lcsChanges returns the minimal number of inserted and deleted lines
+func lcsChanges(a, b []string) int {
+	dp := make([][]int, len(a)+1)
+	for i := range dp {
+		dp[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				dp[i][j] = dp[i+1][j+1] + 1
+			} else {
+				dp[i][j] = max(dp[i+1][j], dp[i][j+1])
+			}
+		}
+	}
+	return len(a) + len(b) - 2*dp[0][0]
+}
+
+func TestLines(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Name string
+		A    string
+		B    string
+	}{
+		{Name: "insert", A: "ac", B: "abc"},
+		{Name: "delete", A: "abc", B: "ac"},
+		{Name: "replace", A: "a", B: "b"},
+		{Name: "paper example", A: "abcabba", B: "cbabac"},
+		{Name: "reversed", A: "abcdefg", B: "gfedcba"},
+		{Name: "interleaved", A: "axbxcxdx", B: "yaybycyd"},
+		{Name: "repeated", A: "aaaabaaaa", B: "aaabaaaaa"},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			a := strings.Split(tc.A, "")
+			b := strings.Split(tc.B, "")
+			edits := Lines(a, b)
+			ea, eb := applyEdits(edits)
+			assert.Equal(a, ea)
+			assert.Equal(b, eb)
+			assert.Equal(lcsChanges(a, b), countChanges(edits))
+		})
+	}
+}
+
+func TestLinesLarge(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	// most lines change, so the edit distance is near the total number of
+	// lines, which must not use quadratic memory
+	const size = 4000
+	a := make([]string, 0, size)
+	b := make([]string, 0, size)
+	for i := 0; i < size; i++ {
+		if i%10 == 0 {
+			a = append(a, fmt.Sprintf("same %d\n", i))
+			b = append(b, fmt.Sprintf("same %d\n", i))
+			continue
+		}
+		a = append(a, fmt.Sprintf("old %d\n", i))
+		b = append(b, fmt.Sprintf("new %d\n", i))
+	}
+	edits := Lines(a, b)
+	ea, eb := applyEdits(edits)
+	assert.Equal(a, ea)
+	assert.Equal(b, eb)
+	assert.Equal(2*(size-size/10), countChanges(edits))
+}
@@ -19,6 +19,7 @@ import (
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
 	"xorkevin.dev/anvil/util/stackset"
+	"xorkevin.dev/anvil/util/starlarkmod"
 	"xorkevin.dev/anvil/workflowengine"
 	"xorkevin.dev/kerrors"
 )
@@ -41,30 +42,6 @@ type (
 	}
 
 	Opt = func(e *Engine)
-
-	loadedModule struct {
-		vals starlark.StringDict
-		err  error
-	}
-
-	modLoader struct {
-		root     fs.FS
-		modCache map[string]*loadedModule
-		set      *stackset.StackSet[string]
-		stderr   io.Writer
-		universe map[string]starlark.StringDict
-		globals  starlark.StringDict
-	}
-
-	fromLoader struct {
-		ctx  context.Context
-		l    *modLoader
-		from string
-	}
-
-	writerPrinter struct {
-		w io.Writer
-	}
 )
 
 func New(fsys fs.FS, opts ...Opt) *Engine {
@@ -150,7 +127,7 @@ func (f NativeFunc) call(t *starlark.Thread, _ *starlark.Builtin, args starlark.
 	return sret, nil
 }
 
-func (e *Engine) createModLoader(events *workflowengine.EventHistory, args map[string]any, stderr io.Writer) *modLoader {
+func (e *Engine) createModLoader(events *workflowengine.EventHistory, args map[string]any, stderr io.Writer) *starlarkmod.Loader {
 	baseMod := starlark.StringDict{}
 	subMods := map[string]starlark.StringDict{
 		"workflow": universeLibWF{
@@ -175,108 +152,33 @@ func (e *Engine) createModLoader(events *workflowengine.EventHistory, args map[s
 	for k, v := range subMods {
 		baseMod[k] = starlarkstruct.FromStringDict(starlarkstruct.Default, v)
 	}
-	return &modLoader{
-		root:     e.fsys,
-		modCache: map[string]*loadedModule{},
-		set:      stackset.New[string](),
-		stderr:   stderr,
-		universe: map[string]starlark.StringDict{
+	globals := starlark.StringDict{
+		"struct": starlark.NewBuiltin("struct", starlarkstruct.Make),
+		"module": starlark.NewBuiltin("module", starlarkstruct.MakeModule),
+	}
+	return starlarkmod.NewLoader(
+		e.fsys,
+		stderr,
+		map[string]starlark.StringDict{
 			e.libname + ":json": starjson.Module.Members,
 			e.libname + ":math": starmath.Module.Members,
 			e.libname + ":time": startime.Module.Members,
 			e.libname:           baseMod,
 		},
-		globals: starlark.StringDict{
-			"struct": starlark.NewBuiltin("struct", starlarkstruct.Make),
-			"module": starlark.NewBuiltin("module", starlarkstruct.MakeModule),
+		func(module string) starlark.StringDict {
+			g := make(starlark.StringDict, len(globals)+2)
+			for k, v := range globals {
+				g[k] = v
+			}
+			g["__anvil_mod__"] = starlark.String(module)
+			g["__anvil_moddir__"] = starlark.String(path.Clean(path.Dir(module)))
+			return g
 		},
-	}
-}
-
-func (w writerPrinter) print(_ *starlark.Thread, msg string) {
-	fmt.Fprintln(w.w, msg)
+	)
 }
 
 // ErrImportCycle is returned when module dependencies form a cycle
-var ErrImportCycle errImportCycle
-
-type (
-	errImportCycle struct{}
-)
-
-func (e errImportCycle) Error() string {
-	return "Import cycle"
-}
-
-func (l *modLoader) getGlobals(module string) starlark.StringDict {
-	g := make(starlark.StringDict, len(l.globals)+2)
-	for k, v := range l.globals {
-		g[k] = v
-	}
-	g["__anvil_mod__"] = starlark.String(module)
-	g["__anvil_moddir__"] = starlark.String(path.Clean(path.Dir(module)))
-	return g
-}
-
-func (l *modLoader) loadFile(ctx context.Context, module string) (starlark.StringDict, error) {
-	if m, ok := l.modCache[module]; ok {
-		return m.vals, m.err
-	}
-	var vals starlark.StringDict
-	b, err := fs.ReadFile(l.root, module)
-	if err == nil {
-		if !l.set.Push(module) {
-			err = fmt.Errorf("%w: Import cycle on module: %s -> %s", ErrImportCycle, strings.Join(l.set.Slice(), ","), module)
-		} else {
-			thread := &starlark.Thread{
-				Name:  module,
-				Print: writerPrinter{w: l.stderr}.print,
-				Load:  fromLoader{ctx: ctx, l: l, from: module}.load,
-			}
-			thread.SetLocal("ctx", ctx)
-			vals, err = starlark.ExecFile(thread, module, b, l.getGlobals(module))
-			v, ok := l.set.Pop()
-			if !ok {
-				err = errors.Join(err, fmt.Errorf("%w: Failed checking import cycle due to missing element on module %s", ErrImportCycle, module))
-			} else if v != module {
-				err = errors.Join(err, fmt.Errorf("%w: Failed checking import cycle due to mismatched element on module %s, %s; %s", ErrImportCycle, module, v, strings.Join(l.set.Slice(), ",")))
-			}
-			if err != nil {
-				vals = nil
-			}
-		}
-	}
-	l.modCache[module] = &loadedModule{
-		vals: vals,
-		err:  err,
-	}
-	return vals, err
-}
-
-func (l *modLoader) load(ctx context.Context, from, module string) (starlark.StringDict, error) {
-	if m, ok := l.universe[module]; ok {
-		return m, nil
-	}
-
-	var name string
-	if path.IsAbs(module) {
-		name = path.Clean(module[1:])
-	} else {
-		name = path.Join(path.Dir(from), module)
-	}
-	if !fs.ValidPath(name) {
-		return nil, fmt.Errorf("%w: Invalid filepath %s from %s", fs.ErrInvalid, module, from)
-	}
-	vals, err := l.loadFile(ctx, name)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to read module %s: %w", name, err)
-	}
-	return vals, nil
-}
-
-func (l fromLoader) load(_ *starlark.Thread, module string) (starlark.StringDict, error) {
-	return l.l.load(l.ctx, l.from, module)
-}
+var ErrImportCycle = starlarkmod.ErrImportCycle
 
 // ErrNoRuntimeLoad is returned when attempting to load modules not ata the top level
 var ErrNoRuntimeLoad errNoRuntimeLoad
@@ -306,7 +208,7 @@ func (e *Engine) Exec(ctx context.Context, events *workflowengine.EventHistory,
 		return nil, kerrors.WithMsg(err, "Failed converting go value args to starlark values")
 	}
 	ml := e.createModLoader(events, args, stderr)
-	vals, err := ml.load(ctx, "", name)
+	vals, err := ml.Load(ctx, "", name)
 	if err != nil {
 		return nil, err
 	}
@@ -319,7 +221,7 @@ func (e *Engine) Exec(ctx context.Context, events *workflowengine.EventHistory,
 	}
 	thread := &starlark.Thread{
 		Name:  name + ".main",
-		Print: writerPrinter{w: stderr}.print,
+		Print: starlarkmod.Print(stderr),
 		Load:  errLoader,
 	}
 	thread.SetLocal("ctx", ctx)